@@ -0,0 +1,77 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	aclActionRefuse = "refuse"
+	aclActionDrop   = "drop"
+)
+
+// clientACL decides which clients can use the server.
+type clientACL struct {
+	allow ipMatcher // can be nil, which means all clients are allowed
+	deny  ipMatcher // can be nil
+	drop  bool      // silently drop rejected queries, otherwise reply REFUSED.
+}
+
+func newClientACL(allow, deny ipMatcher, action string) (*clientACL, error) {
+	a := &clientACL{allow: allow, deny: deny}
+	switch action {
+	case aclActionRefuse, "":
+	case aclActionDrop:
+		a.drop = true
+	default:
+		return nil, fmt.Errorf("unknown acl action [%s]", action)
+	}
+	return a, nil
+}
+
+// allowed reports whether the client ip is allowed. deny list goes first.
+func (a *clientACL) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if a.deny != nil && a.deny.Contains(ip) {
+		return false
+	}
+	return a.allow == nil || a.allow.Contains(ip)
+}
+
+// addrIP returns the ip of a tcp or udp address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+func newRefusedReply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeRefused)
+	return r
+}
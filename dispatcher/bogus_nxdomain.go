@@ -0,0 +1,67 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	bogusNXDomainActionDeny     = "deny"
+	bogusNXDomainActionNXDomain = "nxdomain"
+)
+
+// bogusNXDomain matches replies that contain advertising ips which some
+// ISP resolvers return instead of NXDOMAIN. Like dnsmasq's bogus-nxdomain.
+type bogusNXDomain struct {
+	ips      ipMatcher
+	nxdomain bool // rewrite matched replies to NXDOMAIN, otherwise deny them.
+}
+
+func newBogusNXDomain(ips ipMatcher, action string) (*bogusNXDomain, error) {
+	b := &bogusNXDomain{ips: ips}
+	switch action {
+	case bogusNXDomainActionDeny, "":
+	case bogusNXDomainActionNXDomain:
+		b.nxdomain = true
+	default:
+		return nil, fmt.Errorf("unknown bogus nxdomain action [%s]", action)
+	}
+	return b, nil
+}
+
+// match returns the first ip in r that is in the list.
+func (b *bogusNXDomain) match(r *dns.Msg) (net.IP, bool) {
+	for _, ip := range answerIPs(r) {
+		if b.ips.Contains(ip) {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// setNXDomain turns r into a NXDOMAIN reply.
+func setNXDomain(r *dns.Msg) {
+	r.Rcode = dns.RcodeNameError
+	r.AuthenticatedData = false
+	r.Answer = nil
+	r.Ns = nil
+}
@@ -0,0 +1,103 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/cache"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+
+	"github.com/miekg/dns"
+)
+
+func Test_dispatcher_bogusNXDomain(t *testing.T) {
+	ips, err := iptrie.LoadFromReader(bytes.NewReader([]byte("0.0.0.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		action     string
+		force      bool
+		wantRcode  int
+		wantIP     string
+		wantCached bool
+	}{
+		{"deny", bogusNXDomainActionDeny, false, dns.RcodeSuccess, "0.0.0.2", true},
+		{"nxdomain", bogusNXDomainActionNXDomain, false, dns.RcodeNameError, "", false},
+		{"forced deny", bogusNXDomainActionDeny, true, dns.RcodeSuccess, "0.0.0.1", false},
+		{"forced nxdomain", bogusNXDomainActionNXDomain, true, dns.RcodeNameError, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doPo *domainPolicies
+			if tt.force {
+				doPo = genTestDomainPolicies("com", "", "")
+			}
+			d, err := initTestDispatcherAndServer(0, time.Millisecond*50, ip("0.0.0.1"), ip("0.0.0.2"), nil, doPo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.ecs.local, d.ecs.remote = nil, nil
+			d.cache.Cache = cache.New(8)
+			d.defaultRoute = d.newDefaultRoute()
+			if d.local.bogusNXDomain, err = newBogusNXDomain(ips, tt.action); err != nil {
+				t.Fatal(err)
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, err := d.ServeDNS(context.Background(), nil, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if len(tt.wantIP) != 0 && !r.Answer[0].(*dns.A).A.Equal(ip(tt.wantIP)) {
+				t.Fatalf("want ip %s, got %v", tt.wantIP, r.Answer)
+			}
+			if cached := d.tryGetFromCache(d.cache.Cache, q) != nil; cached != tt.wantCached {
+				t.Fatalf("want cached %v, got %v", tt.wantCached, cached)
+			}
+		})
+	}
+
+	if _, err := newBogusNXDomain(ips, "unknown"); err == nil {
+		t.Fatal("unknown action should be rejected")
+	}
+}
+
+func Test_setNXDomain(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.AuthenticatedData = true
+	r.Answer = append(r.Answer, mustNewRR("example.com. 300 IN A 0.0.0.1"))
+
+	setNXDomain(r)
+	if r.Rcode != dns.RcodeNameError || r.AuthenticatedData || len(r.Answer) != 0 {
+		t.Fatalf("invalid nxdomain reply: %v", r)
+	}
+}
@@ -0,0 +1,375 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	bootstrapMinTTL        = time.Second * 30
+	bootstrapMaxTTL        = time.Hour * 24
+	bootstrapRetryInterval = time.Second * 10
+
+	// happyEyeballsDelay is the delay before starting the next connection attempt. See RFC 8305 5.
+	happyEyeballsDelay = time.Millisecond * 250
+)
+
+// bootstrapResolver resolves upstream hostnames through plain dns servers.
+// Results are cached and re-resolved in the background when their TTL is reached.
+type bootstrapResolver struct {
+	servers []string
+	opts    *dialerOptions
+
+	sync.Mutex
+	records map[string]*bootstrapRecord
+}
+
+type bootstrapRecord struct {
+	sync.Mutex
+	ips []net.IP
+}
+
+// newBootstrapResolver returns a *bootstrapResolver. servers are
+// addresses of plain dns servers, port 53 will be used if it is omitted.
+// opts will be applied to queries and dialed connections.
+func newBootstrapResolver(servers []string, opts *dialerOptions) (*bootstrapResolver, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no bootstrap server")
+	}
+
+	b := &bootstrapResolver{
+		opts:    opts,
+		records: make(map[string]*bootstrapRecord),
+	}
+	for _, s := range servers {
+		if ip := net.ParseIP(s); ip != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap server [%s]: %w", s, err)
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("bootstrap server [%s] must be an ip address", s)
+		}
+		b.servers = append(b.servers, s)
+	}
+	return b, nil
+}
+
+// lookup returns ips of host. If host is an ip, lookup returns it directly.
+func (b *bootstrapResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	b.Lock()
+	rec, ok := b.records[host]
+	if !ok {
+		rec = new(bootstrapRecord)
+		b.records[host] = rec
+	}
+	b.Unlock()
+
+	rec.Lock()
+	defer rec.Unlock()
+	if rec.ips != nil {
+		return rec.ips, nil
+	}
+
+	ips, ttl, err := b.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	rec.ips = ips
+	time.AfterFunc(ttl, func() { b.refresh(host, rec) })
+	return ips, nil
+}
+
+// refresh re-resolves host in the background. If it failed, the old
+// ips will be kept and refresh will try again later.
+func (b *bootstrapResolver) refresh(host string, rec *bootstrapRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), generalReadTimeout*2)
+	defer cancel()
+
+	ips, ttl, err := b.resolve(ctx, host)
+	if err != nil {
+		time.AfterFunc(bootstrapRetryInterval, func() { b.refresh(host, rec) })
+		return
+	}
+	rec.Lock()
+	rec.ips = ips
+	rec.Unlock()
+	time.AfterFunc(ttl, func() { b.refresh(host, rec) })
+}
+
+// resolve queries A and AAAA records of host concurrently.
+func (b *bootstrapResolver) resolve(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	results := make(chan result, 2)
+	for _, qtype := range [...]uint16{dns.TypeA, dns.TypeAAAA} {
+		qtype := qtype
+		go func() {
+			ips, ttl, err := b.resolveType(ctx, host, qtype)
+			results <- result{ips: ips, ttl: ttl, err: err}
+		}()
+	}
+
+	ttl = bootstrapMaxTTL
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if len(r.ips) != 0 && r.ttl < ttl {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no ip address found for %s", host)
+		}
+		return nil, 0, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	if ttl < bootstrapMinTTL {
+		ttl = bootstrapMinTTL
+	}
+	return ips, ttl, nil
+}
+
+// resolveType tries bootstrap servers in order until one of them replies.
+func (b *bootstrapResolver) resolveType(ctx context.Context, host string, qtype uint16) (ips []net.IP, ttl time.Duration, err error) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(host), qtype)
+
+	for _, server := range b.servers {
+		// dns.Client is not safe for concurrent use, it modifies itself in ExchangeContext.
+		c := &dns.Client{Net: "udp", Timeout: generalReadTimeout, Dialer: b.opts.dialer("udp")}
+		var r *dns.Msg
+		r, _, err = c.ExchangeContext(ctx, q, server)
+		if err != nil {
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("server %s returned rcode %s", server, dns.RcodeToString[r.Rcode])
+			continue
+		}
+
+		ttl = bootstrapMaxTTL
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if rr.Header().Rrtype != qtype {
+				continue
+			}
+			ips = append(ips, ip)
+			if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, err
+}
+
+// sortHappyEyeballs interleaves ipv6 and ipv4 addresses, ipv6 first. See RFC 8305 4.
+func sortHappyEyeballs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+// dialHappyEyeballs dials addrs one by one, starting the next attempt after
+// happyEyeballsDelay or immediately if the previous one failed.
+// It returns the first established connection and closes the others.
+func dialHappyEyeballs[T any](ctx context.Context, addrs []string, dial func(ctx context.Context, addr string) (T, error), closeConn func(T)) (T, error) {
+	type result struct {
+		c   T
+		err error
+	}
+
+	var zero T
+	if len(addrs) == 0 {
+		return zero, errors.New("no address to dial")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	startNext := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			c, err := dial(ctx, addr)
+			results <- result{c: c, err: err}
+		}()
+	}
+	// closeLater closes connections that are still pending.
+	closeLater := func(pending int) {
+		go func() {
+			for i := 0; i < pending; i++ {
+				if r := <-results; r.err == nil {
+					closeConn(r.c)
+				}
+			}
+		}()
+	}
+
+	var firstErr error
+	startNext()
+	for pending > 0 {
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if next < len(addrs) {
+			timer = time.NewTimer(happyEyeballsDelay)
+			delay = timer.C
+		}
+
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				closeLater(pending)
+				if timer != nil {
+					timer.Stop()
+				}
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-delay:
+			startNext()
+		case <-ctx.Done():
+			closeLater(pending)
+			return zero, ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return zero, firstErr
+}
+
+// lookupAddrs resolves the host of address via b and returns addresses
+// in happy eyeballs order.
+func (b *bootstrapResolver) lookupAddrs(ctx context.Context, address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := b.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = sortHappyEyeballs(ips)
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+// dialContext dials address. The host of address will be resolved by b.
+// Only tcp connections are dialed with happy eyeballs. A udp dial doesn't
+// contact the server, so racing it is pointless. For udp the addresses are
+// tried in order, and the first one that can be dialed is used.
+func (b *bootstrapResolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	addrs, err := b.lookupAddrs(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	d := b.opts.dialer(network)
+	if !strings.HasPrefix(network, "tcp") {
+		var firstErr error
+		for _, addr := range addrs {
+			c, err := d.DialContext(ctx, network, addr)
+			if err == nil {
+				return c, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+	return dialHappyEyeballs(ctx, addrs, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}, func(c net.Conn) { c.Close() })
+}
+
+// dialQUIC dials a quic connection to address. If b is nil, the system resolver will be used.
+// A quic dial includes the handshake, so it's dialed with happy eyeballs like tcp.
+func (b *bootstrapResolver) dialQUIC(ctx context.Context, address string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	if b == nil {
+		return quic.DialAddrEarly(ctx, address, tlsConf, conf)
+	}
+	addrs, err := b.lookupAddrs(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return dialHappyEyeballs(ctx, addrs, func(ctx context.Context, addr string) (*quic.Conn, error) {
+		return quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+	}, func(c *quic.Conn) { c.CloseWithError(0, "") })
+}
@@ -0,0 +1,213 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startBootstrapServer starts a udp dns server that resolves
+// "dns.example." to 127.0.0.1 and ::1.
+func startBootstrapServer(t *testing.T) (addr string, queries *int32, shutdown func()) {
+	queries = new(int32)
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		name := q.Question[0].Name
+		if name != "dns.example." {
+			r.Rcode = dns.RcodeNameError
+			w.WriteMsg(r)
+			return
+		}
+		hdr := dns.RR_Header{Name: name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)})
+		case dns.TypeAAAA:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback})
+		}
+		w.WriteMsg(r)
+	})
+
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: c, Handler: h}
+	go s.ActivateAndServe()
+	return c.LocalAddr().String(), queries, func() { s.Shutdown() }
+}
+
+func Test_bootstrapResolver_lookup(t *testing.T) {
+	addr, queries, shutdown := startBootstrapServer(t)
+	defer shutdown()
+
+	b, err := newBootstrapResolver([]string{addr}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		ips, err := b.lookup(ctx, "dns.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 2 {
+			t.Fatalf("want 2 ips, got %v", ips)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 { // one A and one AAAA
+		t.Fatalf("results should be cached, got %d queries", n)
+	}
+
+	if _, err := b.lookup(ctx, "nx.example"); err == nil {
+		t.Fatal("want an err")
+	}
+
+	// ip should not be resolved
+	if ips, err := b.lookup(ctx, "1.2.3.4"); err != nil || !ips[0].Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Fatalf("lookup ip: %v, %v", ips, err)
+	}
+
+	if _, err := newBootstrapResolver([]string{"dns.google"}, nil); err == nil {
+		t.Fatal("bootstrap server must be an ip")
+	}
+}
+
+func Test_sortHappyEyeballs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("1.0.0.1"), net.ParseIP("::1"), net.ParseIP("1.1.1.2")}
+	want := []string{"::1", "1.1.1.1", "1.0.0.1", "1.1.1.2"}
+	got := sortHappyEyeballs(ips)
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func Test_dialHappyEyeballs(t *testing.T) {
+	var closed int32
+	closeConn := func(string) { atomic.AddInt32(&closed, 1) }
+	dial := func(ctx context.Context, addr string) (string, error) {
+		switch addr {
+		case "refused":
+			return "", errors.New("refused")
+		case "blackhole":
+			<-ctx.Done()
+			return "", ctx.Err()
+		case "slow":
+			time.Sleep(happyEyeballsDelay * 2)
+			return addr, nil
+		default:
+			return addr, nil
+		}
+	}
+
+	tests := []struct {
+		addrs   []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"refused", "ok"}, "ok", false},
+		{[]string{"blackhole", "ok"}, "ok", false},
+		{[]string{"slow", "ok"}, "ok", false},
+		{[]string{"refused", "refused"}, "", true},
+		{nil, "", true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		got, err := dialHappyEyeballs(ctx, tt.addrs, dial, closeConn)
+		cancel()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("dialHappyEyeballs(%v) = %s, %v, want %s", tt.addrs, got, err, tt.want)
+		}
+	}
+
+	// the "slow" connection should be closed.
+	time.Sleep(happyEyeballsDelay * 2)
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Fatalf("want 1 closed conn, got %d", n)
+	}
+}
+
+func Test_upstream_bootstrap(t *testing.T) {
+	bootstrapAddr, _, shutdown := startBootstrapServer(t)
+	defer shutdown()
+
+	// tcp
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: &vServer{ip: net.IPv4(1, 2, 3, 4)}}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	sc := &BasicServerConfig{
+		Addr:      net.JoinHostPort("dns.example", port),
+		Protocol:  "tcp",
+		Bootstrap: []string{bootstrapAddr},
+	}
+	u, err := NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeTestQuery(t, u)
+
+	// doh, sni should be the hostname in url
+	var sni atomic.Value
+	server := httptest.NewUnstartedServer(&dohTestHandler{ip: net.IPv4(1, 2, 3, 4)})
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni.Store(hello.ServerName)
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ = net.SplitHostPort(server.Listener.Addr().String())
+
+	sc = &BasicServerConfig{
+		Protocol:           "doh",
+		Bootstrap:          []string{bootstrapAddr},
+		InsecureSkipVerify: true,
+	}
+	sc.DoH.URL = "https://" + net.JoinHostPort("dns.example", port) + "/dns-query"
+	u, err = NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeTestQuery(t, u)
+	if s, _ := sni.Load().(string); s != "dns.example" {
+		t.Fatalf("want sni dns.example, got %s", s)
+	}
+}
@@ -0,0 +1,210 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/cache"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ednsMACOptionCode is the EDNS0 option that carries the client MAC address,
+// see dnsmasq's --add-mac.
+const ednsMACOptionCode = 65001
+
+// route is the upstreams and policies that serve a query.
+type route struct {
+	name  string
+	cache *cache.Cache // can be nil
+
+	localClient         Upstream // can be nil
+	localIPPolicies     *ipPolicies
+	localDomainPolicies *domainPolicies
+
+	remoteClient     Upstream // can be nil
+	remoteIPPolicies *ipPolicies
+}
+
+// clientGroup is a group of clients that have their own route.
+type clientGroup struct {
+	clients ipMatcher           // can be nil
+	macs    map[string]struct{} // keys are net.HardwareAddr.String()
+	route
+}
+
+func newClientGroup(conf *ClientGroupConfig, maxConcurrentQueries int, rootCAs *x509.CertPool, rl *remoteListLoader, entry *logrus.Entry) (*clientGroup, error) {
+	if len(conf.Clients) == 0 && len(conf.MACs) == 0 {
+		return nil, errors.New("missing args: both clients and macs are empty")
+	}
+	if len(conf.Local.Addr) == 0 && len(conf.Remote.Addr) == 0 {
+		return nil, errors.New("missing args: both local server and remote server are empty")
+	}
+
+	g := &clientGroup{route: route{name: conf.Name}}
+	if len(conf.Clients) != 0 {
+		m, err := newIPMatcherGroup(conf.Clients, rl, entry)
+		if err != nil {
+			return nil, fmt.Errorf("loading clients, %w", err)
+		}
+		g.clients = m
+	}
+	if len(conf.MACs) != 0 {
+		macs, err := parseMACs(conf.MACs)
+		if err != nil {
+			return nil, err
+		}
+		g.macs = macs
+	}
+
+	if len(conf.Local.Addr) != 0 {
+		client, err := NewUpstream(&conf.Local.BasicServerConfig, maxConcurrentQueries, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("init local server: %w", err)
+		}
+		g.localClient = client
+		if len(conf.Local.IPPolicies) != 0 {
+			if g.localIPPolicies, err = newIPPolicies(conf.Local.IPPolicies, rl, entry); err != nil {
+				return nil, fmt.Errorf("loading ip policies, %w", err)
+			}
+		}
+		if len(conf.Local.DomainPolicies) != 0 {
+			if g.localDomainPolicies, err = newDomainPolicies(conf.Local.DomainPolicies, rl, entry); err != nil {
+				return nil, fmt.Errorf("loading domain policies, %w", err)
+			}
+		}
+	}
+
+	if len(conf.Remote.Addr) != 0 {
+		client, err := NewUpstream(&conf.Remote.BasicServerConfig, maxConcurrentQueries, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("init remote server: %w", err)
+		}
+		g.remoteClient = client
+		if len(conf.Remote.IPPolicies) != 0 {
+			if g.remoteIPPolicies, err = newIPPolicies(conf.Remote.IPPolicies, rl, entry); err != nil {
+				return nil, fmt.Errorf("loading remote ip policies, %w", err)
+			}
+		}
+	}
+	return g, nil
+}
+
+// parseMACs parses MAC addresses separated by "|".
+func parseMACs(s string) (map[string]struct{}, error) {
+	macs := make(map[string]struct{})
+	for _, str := range strings.Split(s, "|") {
+		if len(str) == 0 {
+			continue
+		}
+		mac, err := net.ParseMAC(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac address [%s], %w", str, err)
+		}
+		macs[mac.String()] = struct{}{}
+	}
+	return macs, nil
+}
+
+// match reports whether the client belongs to g. ip and mac can be nil.
+func (g *clientGroup) match(ip net.IP, mac net.HardwareAddr) bool {
+	if ip != nil && g.clients != nil && g.clients.Contains(ip) {
+		return true
+	}
+	if mac != nil && g.macs != nil {
+		_, ok := g.macs[mac.String()]
+		return ok
+	}
+	return false
+}
+
+// queryMAC returns the client MAC address that a forwarder added to q.
+// Both the binary and the text form of dnsmasq's --add-mac are supported.
+func queryMAC(q *dns.Msg) net.HardwareAddr {
+	opt := q.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		l, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || l.Code != ednsMACOptionCode {
+			continue
+		}
+		if len(l.Data) == 6 {
+			return net.HardwareAddr(l.Data)
+		}
+		if mac, err := net.ParseMAC(string(l.Data)); err == nil {
+			return mac
+		}
+	}
+	return nil
+}
+
+// stripMACOption returns q without the MAC address option. q is copied if
+// the option is present.
+func stripMACOption(q *dns.Msg) *dns.Msg {
+	if queryMAC(q) == nil {
+		return q
+	}
+	q = q.Copy()
+	opt := q.IsEdns0()
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != ednsMACOptionCode {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	return q
+}
+
+// route returns the route of the client. The first matched client group wins,
+// otherwise it's the default route. client can be nil.
+// The MAC address in q is only used if the client is a trusted forwarder.
+func (d *Dispatcher) route(client net.Addr, q *dns.Msg) *route {
+	if len(d.clientGroups) != 0 {
+		ip := addrIP(client)
+		var mac net.HardwareAddr
+		if ip != nil && d.trustedForwarders != nil && d.trustedForwarders.Contains(ip) {
+			mac = queryMAC(q)
+		}
+		for _, g := range d.clientGroups {
+			if g.match(ip, mac) {
+				return &g.route
+			}
+		}
+	}
+	return d.defaultRoute
+}
+
+func (d *Dispatcher) newDefaultRoute() *route {
+	return &route{
+		name:                "default",
+		cache:               d.cache.Cache,
+		localClient:         d.local.client,
+		localIPPolicies:     d.local.ipPolicies,
+		localDomainPolicies: d.local.domainPolicies,
+		remoteClient:        d.remote.client,
+		remoteIPPolicies:    d.remote.ipPolicies,
+	}
+}
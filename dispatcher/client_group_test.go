@@ -0,0 +1,217 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/cache"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// noMACUpstream is a fakeUpstream that fails if the query still carries
+// the client MAC address.
+type noMACUpstream struct {
+	fakeUpstream
+}
+
+func (u *noMACUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if queryMAC(q) != nil {
+		return nil, errors.New("mac address is sent to upstream")
+	}
+	return u.fakeUpstream.Exchange(ctx, q)
+}
+
+func Test_queryMAC(t *testing.T) {
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	tests := []struct {
+		name string
+		data []byte
+		want net.HardwareAddr
+	}{
+		{"binary", []byte(mac), mac},
+		{"text", []byte("00:11:22:33:44:55"), mac},
+		{"invalid", []byte("invalid"), nil},
+		{"no option", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			if tt.data != nil {
+				q.SetEdns0(512, false)
+				opt := q.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsMACOptionCode, Data: tt.data})
+
+				// the option should survive a round trip
+				b, err := q.Pack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := q.Unpack(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := queryMAC(q); got.String() != tt.want.String() {
+				t.Fatalf("queryMAC() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_stripMACOption(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if stripMACOption(q) != q {
+		t.Fatal("q without the option should not be copied")
+	}
+
+	q.SetEdns0(512, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_LOCAL{Code: ednsMACOptionCode, Data: []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55}},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+	)
+	stripped := stripMACOption(q)
+	if queryMAC(stripped) != nil || len(stripped.IsEdns0().Option) != 1 {
+		t.Fatalf("mac option should be stripped, got %v", stripped.IsEdns0())
+	}
+	if queryMAC(q) == nil {
+		t.Fatal("q should not be modified")
+	}
+}
+
+func Test_dispatcher_clientGroups(t *testing.T) {
+	d, err := initTestDispatcherAndServer(0, 0, ip("0.0.0.1"), ip("0.0.0.2"), nil, genTestDomainPolicies("com", "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.cache.Cache = cache.New(8)
+	d.defaultRoute = d.newDefaultRoute()
+
+	// kids' devices always go through the filtering server.
+	kidsIPs, err := iptrie.LoadFromReader(strings.NewReader("192.168.1.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kids := &clientGroup{clients: kidsIPs}
+	kids.name = "kids"
+	kids.cache = cache.New(8)
+	kids.remoteClient = &fakeUpstream{ip: ip("0.0.0.3")}
+	// work laptops are matched by mac.
+	macs, err := parseMACs("00:11:22:33:44:55|00:11:22:33:44:66")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := &clientGroup{macs: macs}
+	work.name = "work"
+	work.localClient = &noMACUpstream{fakeUpstream{ip: ip("0.0.0.4")}}
+	d.clientGroups = []*clientGroup{kids, work}
+	// only the forwarder can set the mac address.
+	if d.trustedForwarders, err = iptrie.LoadFromReader(strings.NewReader("192.168.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	mac, _ := net.ParseMAC("00:11:22:33:44:66")
+	tests := []struct {
+		name   string
+		client net.Addr
+		mac    net.HardwareAddr
+		want   net.IP
+	}{
+		{"default", &net.UDPAddr{IP: ip("192.168.2.1")}, nil, ip("0.0.0.1")},
+		{"default without client", nil, nil, ip("0.0.0.1")},
+		{"kids", &net.UDPAddr{IP: ip("192.168.1.1")}, nil, ip("0.0.0.3")},
+		{"kids tcp", &net.TCPAddr{IP: ip("192.168.1.2")}, nil, ip("0.0.0.3")},
+		{"work", &net.UDPAddr{IP: ip("192.168.2.1")}, mac, ip("0.0.0.4")},
+		{"kids first", &net.UDPAddr{IP: ip("192.168.1.1")}, mac, ip("0.0.0.3")},
+		{"untrusted mac", &net.UDPAddr{IP: ip("192.168.2.2")}, mac, ip("0.0.0.1")},
+		{"mac without client", nil, mac, ip("0.0.0.1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion("test.com.", dns.TypeA)
+			if tt.mac != nil {
+				q.SetEdns0(512, false)
+				opt := q.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsMACOptionCode, Data: []byte(tt.mac)})
+			}
+			r, err := d.ServeDNS(context.Background(), tt.client, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	// groups don't share cached replies.
+	q := new(dns.Msg)
+	q.SetQuestion("test.com.", dns.TypeA)
+	if r := d.tryGetFromCache(kids.cache, q); r == nil || !r.Answer[0].(*dns.A).A.Equal(ip("0.0.0.3")) {
+		t.Fatalf("want kids' reply in kids' cache, got %v", r)
+	}
+	if r := d.tryGetFromCache(d.cache.Cache, q); r == nil || !r.Answer[0].(*dns.A).A.Equal(ip("0.0.0.1")) {
+		t.Fatalf("want default reply in default cache, got %v", r)
+	}
+}
+
+func Test_InitDispatcher_clientGroups(t *testing.T) {
+	newConf := func() *Config {
+		c := new(Config)
+		c.Server.Remote.Addr = "127.0.0.1:0"
+		return c
+	}
+
+	c := newConf()
+	c.ClientGroups = make([]ClientGroupConfig, 1)
+	c.ClientGroups[0].Name = "work"
+	c.ClientGroups[0].MACs = "00:11:22:33:44:55"
+	c.ClientGroups[0].Remote.Addr = "127.0.0.1:0"
+	d, err := InitDispatcher(c, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.clientGroups) != 1 || d.clientGroups[0].remoteClient == nil || d.clientGroups[0].localClient != nil {
+		t.Fatalf("unexpected client groups %v", d.clientGroups)
+	}
+
+	for name, f := range map[string]func(g *ClientGroupConfig){
+		"no clients":   func(g *ClientGroupConfig) { g.Remote.Addr = "127.0.0.1:0" },
+		"no upstreams": func(g *ClientGroupConfig) { g.MACs = "00:11:22:33:44:55" },
+		"invalid mac": func(g *ClientGroupConfig) {
+			g.MACs = "invalid"
+			g.Remote.Addr = "127.0.0.1:0"
+		},
+	} {
+		c := newConf()
+		c.ClientGroups = make([]ClientGroupConfig, 1)
+		f(&c.ClientGroups[0])
+		if _, err := InitDispatcher(c, logrus.NewEntry(logrus.StandardLogger())); err == nil {
+			t.Fatalf("%s: want an error", name)
+		}
+	}
+}
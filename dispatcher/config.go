@@ -27,8 +27,29 @@ import (
 // Config is config
 type Config struct {
 	Bind struct {
-		Addr     string `yaml:"addr"`
-		Protocol string `yaml:"protocol"`
+		Addr       string `yaml:"addr"`
+		Protocol   string `yaml:"protocol"`
+		MaxUDPSize int    `yaml:"max_udp_size"` // in [512, 65535], default is MaxUDPSize
+
+		// ACL controls which clients can use the server.
+		ACL struct {
+			Allow  string `yaml:"allow"`  // CIDR files separated by "|", empty means all clients are allowed
+			Deny   string `yaml:"deny"`   // CIDR files separated by "|"
+			Action string `yaml:"action"` // "refuse" or "drop", default is "refuse"
+		} `yaml:"acl"`
+
+		RateLimit struct {
+			IPv4Prefix int `yaml:"ipv4_prefix"` // clients are aggregated by prefixes, default is 24
+			IPv6Prefix int `yaml:"ipv6_prefix"` // default is 56
+			MaxClients int `yaml:"max_clients"` // max tracked clients, default is 65536
+
+			QPS   float64 `yaml:"qps"`   // queries per second per client, 0 means no limit
+			Burst int     `yaml:"burst"` // default is qps
+
+			// response rate limiting, udp only
+			ResponsesPerSecond float64 `yaml:"responses_per_second"` // identical responses per second per client, 0 means no limit
+			Slip               int     `yaml:"slip"`                 // default is 2, negative means never slip
+		} `yaml:"rate_limit"`
 	} `yaml:"bind"`
 
 	Dispatcher struct {
@@ -37,6 +58,15 @@ type Config struct {
 			MinTTL uint32 `yaml:"min_ttl"`
 		} `yaml:"cache"`
 		MaxConcurrentQueries int `yaml:"max_concurrent_queries"`
+		RebindingProtection  struct {
+			Enabled   bool   `yaml:"enabled"`
+			Action    string `yaml:"action"`    // "strip" or "refuse", default is "strip"
+			Allowlist string `yaml:"allowlist"` // domain lists separated by "|"
+		} `yaml:"rebinding_protection"`
+		DNSSEC struct {
+			Enabled      bool     `yaml:"enabled"`
+			TrustAnchors []string `yaml:"trust_anchors"` // DS or DNSKEY records, default is the root KSK
+		} `yaml:"dnssec"`
 	} `yaml:"dispatcher"`
 
 	Server struct {
@@ -49,14 +79,43 @@ type Config struct {
 
 			IPPolicies     string `yaml:"ip_policies"`
 			DomainPolicies string `yaml:"domain_policies"`
+
+			BogusNXDomain struct {
+				IPs    string `yaml:"ips"`    // ip lists separated by "|"
+				Action string `yaml:"action"` // "deny" or "nxdomain", default is "deny"
+			} `yaml:"bogus_nxdomain"`
+
+			PoisoningDetection struct {
+				Enabled  bool   `yaml:"enabled"`
+				Wait     uint   `yaml:"wait"`      // in milliseconds, default is 200
+				BogusIPs string `yaml:"bogus_ips"` // ip lists separated by "|"
+				MinRTT   uint   `yaml:"min_rtt"`   // in milliseconds, 0 means measured
+			} `yaml:"poisoning_detection"`
+
+			// ListUpdate configures lists in policies that are http(s) urls.
+			ListUpdate struct {
+				Interval uint   `yaml:"interval"` // in seconds, default is 86400
+				CacheDir string `yaml:"cache_dir"`
+				Socks5   string `yaml:"socks5"`
+				Proxy    string `yaml:"proxy"`
+			} `yaml:"list_update"`
 		} `yaml:"local"`
 
 		Remote struct {
 			BasicServerConfig `yaml:"basic,inline"`
 			DelayStart        int `yaml:"delay_start"`
+
+			IPPolicies   string `yaml:"ip_policies"`
+			IPDenyAction string `yaml:"ip_deny_action"` // "wait" or "servfail", default is "wait"
 		} `yaml:"remote"`
 	} `yaml:"server"`
 
+	// ClientGroups route queries from different clients to different upstreams.
+	ClientGroups []ClientGroupConfig `yaml:"client_groups"`
+	// TrustedForwarders are ip lists separated by "|". Only queries from them
+	// can select client groups by the MAC address, see queryMAC.
+	TrustedForwarders string `yaml:"trusted_forwarders"`
+
 	ECS struct {
 		Local  string `yaml:"local"`
 		Remote string `yaml:"remote"`
@@ -67,11 +126,42 @@ type Config struct {
 	} `yaml:"ca"`
 }
 
+// ClientGroupConfig is a config for a group of clients. Queries from the clients
+// are sent to the group's own upstreams with the group's own policies.
+type ClientGroupConfig struct {
+	Name    string `yaml:"name"`
+	Clients string `yaml:"clients"` // ip lists separated by "|"
+	MACs    string `yaml:"macs"`    // mac addresses separated by "|", see queryMAC
+
+	Local struct {
+		BasicServerConfig `yaml:"basic,inline"`
+		IPPolicies        string `yaml:"ip_policies"`
+		DomainPolicies    string `yaml:"domain_policies"`
+	} `yaml:"local"`
+
+	Remote struct {
+		BasicServerConfig `yaml:"basic,inline"`
+		IPPolicies        string `yaml:"ip_policies"`
+	} `yaml:"remote"`
+}
+
 // BasicServerConfig is a basic config for a upstream dns server.
 type BasicServerConfig struct {
 	Addr     string `yaml:"addr"`
 	Protocol string `yaml:"protocol"`
-	Socks5   string `yaml:"socks5"`
+	Socks5   string `yaml:"socks5"` // [user:pass@]host:port
+	Proxy    string `yaml:"proxy"`  // proxy url, see newProxyDialer
+
+	// Timeout is the query timeout in milliseconds, default is 3000.
+	Timeout uint `yaml:"timeout"`
+
+	// Bootstrap is a list of plain dns servers that resolve the host in Addr.
+	Bootstrap []string `yaml:"bootstrap"`
+
+	// socket options of outbound connections
+	LocalAddr string `yaml:"local_addr"`
+	Interface string `yaml:"interface"` // linux only
+	SoMark    int    `yaml:"so_mark"`   // linux only
 
 	TCP struct {
 		IdleTimeout uint `yaml:"idle_timeout"`
@@ -82,10 +172,24 @@ type BasicServerConfig struct {
 		IdleTimeout uint   `yaml:"idle_timeout"`
 	} `yaml:"dot"`
 
+	DoQ struct {
+		ServerName  string `yaml:"server_name"`
+		IdleTimeout uint   `yaml:"idle_timeout"`
+	} `yaml:"doq"`
+
 	DoH struct {
-		URL string `yaml:"url"`
+		URL    string `yaml:"url"`
+		HTTP3  string `yaml:"http3"`  // "force" or "auto", empty means disabled
+		Method string `yaml:"method"` // "GET" or "POST", default is "GET"
 	} `yaml:"doh"`
 
+	// TLS settings of dot/doh/doq.
+	TLS struct {
+		ClientCert string   `yaml:"client_cert"` // PEM file of the client certificate for mutual TLS
+		ClientKey  string   `yaml:"client_key"`
+		SPKIPins   []string `yaml:"spki_pins"` // base64 encoded SHA-256 hashes of the server's SPKI
+	} `yaml:"tls"`
+
 	// for test and experts only
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
 }
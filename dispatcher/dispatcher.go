@@ -30,13 +30,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/pool"
 
 	"github.com/miekg/dns"
 
-	netlist "github.com/IrineSistiana/net-list"
 	"github.com/sirupsen/logrus"
 )
 
@@ -44,7 +44,8 @@ const (
 	// MaxUDPSize max udp packet size
 	MaxUDPSize = 1480
 
-	queryTimeout = time.Second * 3
+	// defaultUpstreamTimeout is the query timeout of upstreams that don't set one.
+	defaultUpstreamTimeout = time.Second * 3
 )
 
 var (
@@ -70,17 +71,33 @@ type Dispatcher struct {
 		checkCNAME          bool
 		ipPolicies          *ipPolicies
 		domainPolicies      *domainPolicies
+		poisoningDetector   *poisoningDetector
+		bogusNXDomain       *bogusNXDomain
 	}
 
 	remote struct {
 		client     Upstream
 		delayStart time.Duration
+
+		ipPolicies     *ipPolicies
+		servfailOnDeny bool // return SERVFAIL if the result is denied, otherwise wait for the local result
 	}
 
 	ecs struct {
 		local  *edns0subnet
 		remote *edns0subnet
 	}
+
+	dnssec    *dnssecValidator
+	rebinding *rebindingFilter
+	acl       *clientACL
+	limiter   *rateLimiter
+
+	clientGroups      []*clientGroup
+	trustedForwarders ipMatcher // clients that can set the client MAC address, can be nil
+	defaultRoute      *route
+
+	queryTimeout time.Duration // timeout of queries from clients
 }
 
 type edns0subnet struct {
@@ -124,6 +141,15 @@ func InitDispatcher(conf *Config, entry *logrus.Entry) (*Dispatcher, error) {
 		d.cache.minTTL = conf.Dispatcher.Cache.MinTTL
 	}
 
+	if conf.Dispatcher.DNSSEC.Enabled {
+		v, err := newDNSSECValidator(conf.Dispatcher.DNSSEC.TrustAnchors)
+		if err != nil {
+			return nil, fmt.Errorf("init dnssec validator: %w", err)
+		}
+		d.dnssec = v
+		d.entry.Info("initDispatcher: dnssec validation enabled")
+	}
+
 	var rootCAs *x509.CertPool
 	var err error
 	if len(conf.CA.Path) != 0 {
@@ -156,27 +182,161 @@ func InitDispatcher(conf *Config, entry *logrus.Entry) (*Dispatcher, error) {
 		}
 		d.remote.client = client
 		d.remote.delayStart = time.Millisecond * time.Duration(conf.Server.Remote.DelayStart)
-		if d.remote.delayStart >= queryTimeout {
-			return nil, fmt.Errorf("init remote server: remoteServerDelayStart is longer than globle query timeout %s", queryTimeout)
-		}
+	}
+
+	listUpdate := conf.Server.Local.ListUpdate
+	listProxy, err := mergeProxySettings(listUpdate.Proxy, listUpdate.Socks5)
+	if err != nil {
+		return nil, fmt.Errorf("init list loader, %w", err)
+	}
+	rl, err := newRemoteListLoader(time.Duration(listUpdate.Interval)*time.Second, listUpdate.CacheDir, listProxy, d.entry)
+	if err != nil {
+		return nil, fmt.Errorf("init list loader, %w", err)
 	}
 
 	if len(conf.Server.Local.IPPolicies) != 0 {
-		p, err := newIPPolicies(conf.Server.Local.IPPolicies, d.entry)
+		p, err := newIPPolicies(conf.Server.Local.IPPolicies, rl, d.entry)
 		if err != nil {
 			return nil, fmt.Errorf("loading ip policies, %w", err)
 		}
 		d.local.ipPolicies = p
 	}
 
+	if len(conf.Server.Remote.IPPolicies) != 0 {
+		p, err := newIPPolicies(conf.Server.Remote.IPPolicies, rl, d.entry)
+		if err != nil {
+			return nil, fmt.Errorf("loading remote ip policies, %w", err)
+		}
+		d.remote.ipPolicies = p
+		switch conf.Server.Remote.IPDenyAction {
+		case "wait", "":
+		case "servfail":
+			d.remote.servfailOnDeny = true
+		default:
+			return nil, fmt.Errorf("unknown remote ip deny action [%s]", conf.Server.Remote.IPDenyAction)
+		}
+	}
+
 	if len(conf.Server.Local.DomainPolicies) != 0 {
-		p, err := newDomainPolicies(conf.Server.Local.DomainPolicies, d.entry)
+		p, err := newDomainPolicies(conf.Server.Local.DomainPolicies, rl, d.entry)
 		if err != nil {
 			return nil, fmt.Errorf("loading domain policies, %w", err)
 		}
 		d.local.domainPolicies = p
 	}
 
+	for i := range conf.ClientGroups {
+		g, err := newClientGroup(&conf.ClientGroups[i], conf.Dispatcher.MaxConcurrentQueries, rootCAs, rl, d.entry)
+		if err != nil {
+			return nil, fmt.Errorf("init client group #%d [%s]: %w", i, conf.ClientGroups[i].Name, err)
+		}
+		if d.cache.Cache != nil { // groups don't share cached replies
+			g.cache = cache.New(conf.Dispatcher.Cache.Size)
+		}
+		d.clientGroups = append(d.clientGroups, g)
+		d.entry.Infof("initDispatcher: client group [%s] loaded", g.name)
+	}
+
+	if len(conf.TrustedForwarders) != 0 {
+		g, err := newIPMatcherGroup(conf.TrustedForwarders, rl, d.entry)
+		if err != nil {
+			return nil, fmt.Errorf("loading trusted forwarders, %w", err)
+		}
+		d.trustedForwarders = g
+	}
+
+	if acl := conf.Bind.ACL; len(acl.Allow) != 0 || len(acl.Deny) != 0 {
+		var allow, deny ipMatcher
+		if len(acl.Allow) != 0 {
+			l, err := loadNetList(acl.Allow)
+			if err != nil {
+				return nil, fmt.Errorf("loading acl allow list, %w", err)
+			}
+			allow = l
+		}
+		if len(acl.Deny) != 0 {
+			l, err := loadNetList(acl.Deny)
+			if err != nil {
+				return nil, fmt.Errorf("loading acl deny list, %w", err)
+			}
+			deny = l
+		}
+		a, err := newClientACL(allow, deny, acl.Action)
+		if err != nil {
+			return nil, err
+		}
+		d.acl = a
+	}
+
+	if limit := conf.Bind.RateLimit; limit.QPS > 0 || limit.ResponsesPerSecond > 0 {
+		v4Prefix, v6Prefix, maxClients, slip := limit.IPv4Prefix, limit.IPv6Prefix, limit.MaxClients, limit.Slip
+		if v4Prefix <= 0 || v4Prefix > 32 {
+			v4Prefix = defaultRateLimitIPv4Prefix
+		}
+		if v6Prefix <= 0 || v6Prefix > 128 {
+			v6Prefix = defaultRateLimitIPv6Prefix
+		}
+		if maxClients <= 0 {
+			maxClients = defaultRateLimitMaxClients
+		}
+		switch {
+		case slip == 0:
+			slip = defaultRRLSlip
+		case slip < 0:
+			slip = 0
+		}
+		d.limiter = newRateLimiter(v4Prefix, v6Prefix, maxClients, limit.QPS, limit.Burst, limit.ResponsesPerSecond, slip)
+		d.entry.Info("initDispatcher: rate limiting enabled")
+	}
+
+	if rp := conf.Dispatcher.RebindingProtection; rp.Enabled {
+		var allowlist domainMatcher
+		if len(rp.Allowlist) != 0 {
+			g, err := newDomainMatcherGroup(rp.Allowlist, rl, d.entry)
+			if err != nil {
+				return nil, fmt.Errorf("loading rebinding protection allowlist, %w", err)
+			}
+			allowlist = g
+		}
+		f, err := newRebindingFilter(rp.Action, allowlist)
+		if err != nil {
+			return nil, err
+		}
+		d.rebinding = f
+		d.entry.Info("initDispatcher: rebinding protection enabled")
+	}
+
+	if bn := conf.Server.Local.BogusNXDomain; len(bn.IPs) != 0 {
+		g, err := newIPMatcherGroup(bn.IPs, rl, d.entry)
+		if err != nil {
+			return nil, fmt.Errorf("loading bogus nxdomain ips, %w", err)
+		}
+		b, err := newBogusNXDomain(g, bn.Action)
+		if err != nil {
+			return nil, err
+		}
+		d.local.bogusNXDomain = b
+	}
+
+	if pd := conf.Server.Local.PoisoningDetection; pd.Enabled {
+		p := &poisoningDetector{
+			wait:   time.Duration(pd.Wait) * time.Millisecond,
+			minRTT: time.Duration(pd.MinRTT) * time.Millisecond,
+		}
+		if p.wait == 0 {
+			p.wait = defaultPoisoningDetectionWait
+		}
+		if len(pd.BogusIPs) != 0 {
+			g, err := newIPMatcherGroup(pd.BogusIPs, rl, d.entry)
+			if err != nil {
+				return nil, fmt.Errorf("loading bogus ips, %w", err)
+			}
+			p.bogusIPs = g
+		}
+		d.local.poisoningDetector = p
+		d.entry.Info("initDispatcher: poisoning detection enabled")
+	}
+
 	if len(conf.ECS.Local) != 0 {
 		subnet, err := newEDNS0SubnetFromStr(conf.ECS.Local)
 		if err != nil {
@@ -195,6 +355,8 @@ func InitDispatcher(conf *Config, entry *logrus.Entry) (*Dispatcher, error) {
 		d.entry.Info("initDispatcher: remote server ECS enabled")
 	}
 
+	d.defaultRoute = d.newDefaultRoute()
+	d.queryTimeout = queryTimeout(conf)
 	return d, nil
 }
 
@@ -242,61 +404,128 @@ func newEDNS0SubnetFromStr(s string) (*dns.EDNS0_SUBNET, error) {
 	return edns0Subnet, nil
 }
 
+// queryTimeout returns the timeout of queries from clients. It's long enough
+// for the slowest upstream, including the delay of the remote server.
+func queryTimeout(conf *Config) time.Duration {
+	var t time.Duration
+	longer := func(sc *BasicServerConfig, delay time.Duration) {
+		if len(sc.Addr) != 0 && sc.timeout()+delay > t {
+			t = sc.timeout() + delay
+		}
+	}
+	longer(&conf.Server.Local.BasicServerConfig, 0)
+	longer(&conf.Server.Remote.BasicServerConfig, time.Millisecond*time.Duration(conf.Server.Remote.DelayStart))
+	for i := range conf.ClientGroups {
+		longer(&conf.ClientGroups[i].Local.BasicServerConfig, 0)
+		longer(&conf.ClientGroups[i].Remote.BasicServerConfig, 0)
+	}
+	return t
+}
+
 func isUnusualType(q *dns.Msg) bool {
 	return q.Opcode != dns.OpcodeQuery || len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || (q.Question[0].Qtype != dns.TypeA && q.Question[0].Qtype != dns.TypeAAAA)
 }
 
-// ServeDNS sends q to upstreams and return first valid result.
+// ServeDNS sends q from client to upstreams and return first valid result.
+// client is used to select the client group, it can be nil.
 // Note: q will be unsafe to modify even after ServeDNS is returned.
 // (Some goroutine may still be running even after ServeDNS is returned)
-func (d *Dispatcher) ServeDNS(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
+func (d *Dispatcher) ServeDNS(ctx context.Context, client net.Addr, q *dns.Msg) (r *dns.Msg, err error) {
 	requestLogger := pool.GetRequestLogger(d.entry.Logger, q)
 	defer pool.ReleaseRequestLogger(requestLogger)
 
+	rt := d.route(client, q)
+	if len(d.clientGroups) != 0 {
+		requestLogger.Debugf("client %s, route [%s]", client, rt.name)
+	}
+	q = stripMACOption(q) // don't leak the client MAC address to upstreams
+
 	hasECS := isMsgHasECS(q) // don't use cache for msg with ECS
+	validate := d.dnssec != nil && !q.CheckingDisabled
 
 	if !hasECS {
-		if r = d.tryGetFromCache(q); r != nil {
+		// the list may be updated after r was cached.
+		if r = d.tryGetFromCache(rt.cache, q); r != nil && !d.isBogusNXDomain(r, requestLogger) {
 			requestLogger.Debug("cache hit")
+			if d.dnssec != nil {
+				stripDNSSECRecords(q, r)
+			}
 			return r, nil
 		}
 	}
 
-	r, err = d.exchangeDNS(ctx, q)
+	r, err = d.exchangeDNS(ctx, q, rt)
 	if err != nil {
 		return nil, err
 	}
+	if d.dnssec != nil && q.CheckingDisabled { // not validated, the AD bit from upstreams is not trusted
+		r.AuthenticatedData = false
+	}
 
-	if !hasECS {
-		d.tryAddToCache(r)
+	if d.rebinding != nil {
+		if msg := d.rebinding.filter(q, r); len(msg) != 0 {
+			requestLogger.Infof("rebinding protection: %s", msg)
+		}
+	}
+
+	// replies to CD queries are not validated, don't cache them, see RFC 4035 4.7.
+	if !hasECS && (validate || d.dnssec == nil) && !d.isBogusNXDomain(r, requestLogger) {
+		d.tryAddToCache(rt.cache, r)
+	}
+	if d.dnssec != nil {
+		stripDNSSECRecords(q, r)
 	}
 	return r, nil
 }
 
-func (d *Dispatcher) tryGetFromCache(q *dns.Msg) (r *dns.Msg) {
-	if d.cache.Cache != nil && len(q.Question) == 1 { // must have only one question
-		return d.cache.Get(q.Question[0], q.Id)
+// isBogusNXDomain checks r with the bogus nxdomain list. If the action is
+// nxdomain, r will be rewritten to a NXDOMAIN reply. It returns true if r
+// is bogus and can't be cached.
+func (d *Dispatcher) isBogusNXDomain(r *dns.Msg, requestLogger *logrus.Entry) bool {
+	if d.local.bogusNXDomain == nil {
+		return false
+	}
+	ip, ok := d.local.bogusNXDomain.match(r)
+	if !ok {
+		return false
+	}
+	if d.local.bogusNXDomain.nxdomain {
+		requestLogger.Debugf("isBogusNXDomain: ip %s is bogus, rewritten to nxdomain", ip)
+		setNXDomain(r)
+		return false // NXDOMAIN won't be cached anyway
+	}
+	requestLogger.Debugf("isBogusNXDomain: ip %s is bogus", ip)
+	return true
+}
+
+func (d *Dispatcher) tryGetFromCache(c *cache.Cache, q *dns.Msg) (r *dns.Msg) {
+	if c != nil && len(q.Question) == 1 { // must have only one question
+		return c.Get(q.Question[0], q.Id)
 	}
 	return nil
 }
 
-// tryAddToCache adds r to cache and modifies its ttl
-func (d *Dispatcher) tryAddToCache(r *dns.Msg) {
-	// must only have one question and Rcode must be success
+// tryAddToCache adds r to c and modifies its ttl
+func (d *Dispatcher) tryAddToCache(c *cache.Cache, r *dns.Msg) {
+	// must only have one question and Rcode must be success, truncated reply is incomplete
 	// TODO: make cache handle ECS
-	if d.cache.Cache != nil && len(r.Question) == 1 && r.Rcode == dns.RcodeSuccess {
+	if c != nil && len(r.Question) == 1 && r.Rcode == dns.RcodeSuccess && !r.Truncated {
 		ttl := utils.GetAnswerMinTTL(r)
 		if ttl < d.cache.minTTL {
 			ttl = d.cache.minTTL
 		}
 		expireAt := time.Now().Add(time.Duration(ttl) * time.Second)
-		d.cache.Add(r.Question[0], r, expireAt)
+		c.Add(r.Question[0], r, expireAt)
 
 		utils.SetAnswerTTL(r, ttl) // if r is added to cache, modify its ttl as well.
 	}
 }
 
-func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg, rt *route) (*dns.Msg, error) {
+	// once we have a result, the other upstream is no longer needed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	requestLogger := pool.GetRequestLogger(d.entry.Logger, q)
 	resChan := pool.GetResChan()
 	upstreamFailedNotificationChan := pool.GetNotificationChan()
@@ -305,11 +534,27 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 	serveDNSWG.Add(1)
 	defer serveDNSWG.Done()
 
-	doLocal, doRemote, forceLocal := d.selectUpstreams(q)
+	doLocal, doRemote, forceLocal := d.selectUpstreams(q, rt, requestLogger)
 	requestLogger.Debugf("exchangeDNS: selectUpstreams: dl: %v, fl: %v", doLocal, forceLocal)
 
+	// clients set CD if they want to validate replies themselves.
+	validate := d.dnssec != nil && !q.CheckingDisabled
+	if validate {
+		q = setDO(q)
+	}
+
 	upstreamWG := sync.WaitGroup{}
 	var localNotificationChan chan notification.Signal
+	// set if a result was denied because it is bogus. If no one else can
+	// answer the query, the client gets SERVFAIL instead of no reply.
+	var bogus atomic.Bool
+
+	// compare the local reply with the remote reply.
+	detectPoisoning := d.local.poisoningDetector != nil && doLocal && doRemote && !forceLocal
+	var remote *remoteReply
+	if detectPoisoning {
+		remote = newRemoteReply()
+	}
 
 	// local
 	if doLocal {
@@ -328,8 +573,9 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 			}
 
 			queryStart := time.Now()
-			r, err := d.local.client.Exchange(ctx, qToLocal)
-			rtt := time.Since(queryStart).Milliseconds()
+			r, err := rt.localClient.Exchange(ctx, qToLocal)
+			queryRTT := time.Since(queryStart)
+			rtt := queryRTT.Milliseconds()
 			if err != nil {
 				if err != context.Canceled && err != context.DeadlineExceeded {
 					requestLogger.Warnf("exchangeDNS: local server failed after %dms: %v", rtt, err)
@@ -338,13 +584,34 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 				return
 			}
 
-			if !forceLocal && !d.acceptLocalRes(r, requestLogger) {
+			var ds dnssecStatus
+			if validate {
+				ds = d.validate(ctx, rt.localClient, q, r, requestLogger)
+			}
+
+			switch {
+			case ds == dnssecBogus && (forceLocal || !doRemote): // no one else can answer it
+				pool.ReleaseMsg(r)
+				r = newServfailReply(q)
+			case !forceLocal && !d.acceptLocalRes(r, ds, rt, requestLogger):
 				pool.ReleaseMsg(r)
+				if ds == dnssecBogus {
+					bogus.Store(true)
+				}
 				requestLogger.Debugf("exchangeDNS: local result denied, rtt: %dms", rtt)
 				notification.NoBlockNotify(localNotificationChan, notification.Failed)
 				return
 			}
 
+			if detectPoisoning {
+				if reason := d.local.poisoningDetector.check(ctx, q, r, queryRTT, remote); len(reason) != 0 {
+					pool.ReleaseMsg(r)
+					requestLogger.Infof("exchangeDNS: local result is likely poisoned, rtt: %dms: %s", rtt, reason)
+					notification.NoBlockNotify(localNotificationChan, notification.Failed)
+					return
+				}
+			}
+
 			requestLogger.Debugf("exchangeDNS: local result accepted, rtt: %dms", rtt)
 			select {
 			case resChan <- r:
@@ -358,7 +625,8 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 	go func() {
 		// remote
 		if doRemote {
-			if doLocal && d.remote.delayStart > 0 {
+			// the local query will wait for the remote reply, don't delay it.
+			if doLocal && d.remote.delayStart > 0 && !detectPoisoning {
 				delayTimer := pool.GetTimer(d.remote.delayStart)
 				defer pool.ReleaseTimer(delayTimer)
 				select {
@@ -380,16 +648,60 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 			}
 
 			queryStart := time.Now()
-			r, err := d.remote.client.Exchange(ctx, qToRemote)
+			r, err := rt.remoteClient.Exchange(ctx, qToRemote)
 			rtt := time.Since(queryStart).Milliseconds()
 			if err != nil {
 				if err != context.Canceled && err != context.DeadlineExceeded {
 					requestLogger.Warnf("exchangeDNS: remote server failed after %dms: %v", rtt, err)
 				}
+				if detectPoisoning {
+					remote.set(nil)
+				}
 				goto skipRemote
 			}
 
 			requestLogger.Debugf("exchangeDNS: get reply from remote, rtt: %dms", rtt)
+			if validate && d.validate(ctx, rt.remoteClient, q, r, requestLogger) == dnssecBogus {
+				pool.ReleaseMsg(r)
+				// like a denied result, wait for the local result if there is one.
+				if doLocal {
+					requestLogger.Debugf("exchangeDNS: remote result is bogus, rtt: %dms", rtt)
+					bogus.Store(true)
+					if detectPoisoning {
+						remote.set(nil)
+					}
+					goto skipRemote
+				}
+				r = newServfailReply(q)
+			}
+
+			if rt.remoteIPPolicies != nil && !d.acceptRemoteRes(r, rt.remoteIPPolicies, requestLogger) {
+				pool.ReleaseMsg(r)
+				// reply SERVFAIL if there is no local result to wait for.
+				if !d.remote.servfailOnDeny && doLocal {
+					requestLogger.Debugf("exchangeDNS: remote result denied, rtt: %dms", rtt)
+					if detectPoisoning {
+						remote.set(nil)
+					}
+					goto skipRemote
+				}
+				requestLogger.Debugf("exchangeDNS: remote result denied, reply SERVFAIL, rtt: %dms", rtt)
+				r = newServfailReply(q)
+			}
+
+			// the local reply is preferred, wait for its result.
+			if detectPoisoning {
+				remote.set(r.Copy())
+				select {
+				case n := <-localNotificationChan:
+					if n == notification.Succeed {
+						goto skipRemote
+					}
+				case <-ctx.Done():
+					goto skipRemote
+				}
+			}
+
 			select {
 			case resChan <- r:
 			default:
@@ -402,7 +714,14 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 		// avoid below select{} choose upstreamFailedNotificationChan
 		// if both resChan and upstreamFailedNotificationChan are selectable
 		if len(resChan) == 0 {
-			notification.NoBlockNotify(upstreamFailedNotificationChan, notification.Failed)
+			if bogus.Load() {
+				select {
+				case resChan <- newServfailReply(q):
+				default:
+				}
+			} else {
+				notification.NoBlockNotify(upstreamFailedNotificationChan, notification.Failed)
+			}
 		}
 
 		// exchangeDNS is done
@@ -427,14 +746,17 @@ func (d *Dispatcher) exchangeDNS(ctx context.Context, q *dns.Msg) (*dns.Msg, err
 	}
 }
 
-func (d *Dispatcher) selectUpstreams(q *dns.Msg) (doLocal, doRemote, forceLocal bool) {
-	if d.local.client != nil {
+func (d *Dispatcher) selectUpstreams(q *dns.Msg, rt *route, requestLogger *logrus.Entry) (doLocal, doRemote, forceLocal bool) {
+	if rt.localClient != nil {
 		doLocal = true
 		if isUnusualType(q) {
 			doLocal = !d.local.denyUnusualTypes
 		} else {
-			if d.local.domainPolicies != nil {
-				p := d.local.domainPolicies.check(q.Question[0].Name)
+			if rt.localDomainPolicies != nil {
+				p, rule := rt.localDomainPolicies.check(q.Question[0].Name)
+				if p != policyActionMissing {
+					requestLogger.Debugf("selectUpstreams: domain matched by rule [%s]", rule)
+				}
 				switch p {
 				case policyActionForce:
 					doLocal = true
@@ -448,7 +770,7 @@ func (d *Dispatcher) selectUpstreams(q *dns.Msg) (doLocal, doRemote, forceLocal
 		}
 	}
 
-	if d.remote.client != nil {
+	if rt.remoteClient != nil {
 		doRemote = true
 		switch {
 		case forceLocal:
@@ -499,12 +821,48 @@ func copyAndAppendECSIfNotExist(q *dns.Msg, ecs *edns0subnet) (m *dns.Msg) {
 	return qCopy
 }
 
-func (d *Dispatcher) acceptLocalRes(res *dns.Msg, requestLogger *logrus.Entry) (ok bool) {
+// validate validates r from u and logs the result.
+func (d *Dispatcher) validate(ctx context.Context, u Upstream, q, r *dns.Msg, requestLogger *logrus.Entry) dnssecStatus {
+	ds, err := d.dnssec.validate(ctx, u, q, r)
+	if err != nil {
+		requestLogger.Warnf("validate: %s: %v", ds, err)
+	} else {
+		requestLogger.Debugf("validate: %s", ds)
+	}
+	return ds
+}
+
+func newServfailReply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeServerFailure)
+	return r
+}
+
+// acceptLocalRes checks whether res from the local server of rt is acceptable.
+// ds is the dnssec status of res, bogus results are always denied.
+func (d *Dispatcher) acceptLocalRes(res *dns.Msg, ds dnssecStatus, rt *route, requestLogger *logrus.Entry) (ok bool) {
 	if res == nil {
 		requestLogger.Debug("acceptLocalRes: false: result is nil")
 		return false
 	}
 
+	if ds == dnssecBogus {
+		requestLogger.Debug("acceptLocalRes: false: dnssec bogus")
+		return false
+	}
+
+	if d.local.bogusNXDomain != nil {
+		if ip, ok := d.local.bogusNXDomain.match(res); ok {
+			if d.local.bogusNXDomain.nxdomain {
+				setNXDomain(res)
+				requestLogger.Debugf("acceptLocalRes: true: ip %s is bogus, rewritten to nxdomain", ip)
+				return true
+			}
+			requestLogger.Debugf("acceptLocalRes: false: ip %s is bogus", ip)
+			return false
+		}
+	}
+
 	if res.Rcode != dns.RcodeSuccess {
 		requestLogger.Debugf("acceptLocalRes: false: Rcode=%s", dns.RcodeToString[res.Rcode])
 		return false
@@ -521,16 +879,16 @@ func (d *Dispatcher) acceptLocalRes(res *dns.Msg, requestLogger *logrus.Entry) (
 	}
 
 	// check CNAME
-	if d.local.domainPolicies != nil && d.local.checkCNAME == true {
+	if rt.localDomainPolicies != nil && d.local.checkCNAME == true {
 		for i := range res.Answer {
 			if cname, ok := res.Answer[i].(*dns.CNAME); ok {
-				p := d.local.domainPolicies.check(cname.Target)
+				p, rule := rt.localDomainPolicies.check(cname.Target)
 				switch p {
 				case policyActionAccept, policyActionForce:
-					requestLogger.Debug("acceptLocalRes: true: matched by CNAME")
+					requestLogger.Debugf("acceptLocalRes: true: CNAME %s matched by rule [%s]", cname.Target, rule)
 					return true
 				case policyActionDeny:
-					requestLogger.Debug("acceptLocalRes: false: matched by CNAME")
+					requestLogger.Debugf("acceptLocalRes: false: CNAME %s matched by rule [%s]", cname.Target, rule)
 					return false
 				default: // policyMissing
 					continue
@@ -541,33 +899,27 @@ func (d *Dispatcher) acceptLocalRes(res *dns.Msg, requestLogger *logrus.Entry) (
 
 	// check ip
 	var hasIP bool
-	if d.local.ipPolicies != nil {
+	if rt.localIPPolicies != nil {
 		for i := range res.Answer {
-			var ip netlist.IPv6
-			var err error
+			var ip net.IP
 			switch tmp := res.Answer[i].(type) {
 			case *dns.A:
-				ip, err = netlist.Conv(tmp.A)
+				ip = tmp.A
 			case *dns.AAAA:
-				ip, err = netlist.Conv(tmp.AAAA)
+				ip = tmp.AAAA
 			default:
 				continue
 			}
 
 			hasIP = true
 
-			if err != nil {
-				requestLogger.Warnf("acceptLocalRes: internal err: netlist.Conv %v", err)
-				continue
-			}
-
-			p := d.local.ipPolicies.check(ip)
+			p := rt.localIPPolicies.check(ip)
 			switch p {
 			case policyActionAccept:
-				requestLogger.Debug("acceptLocalRes: true: matched by ip")
+				requestLogger.Debugf("acceptLocalRes: true: matched by ip %s", ip)
 				return true
 			case policyActionDeny:
-				requestLogger.Debug("acceptLocalRes: false: matched by ip")
+				requestLogger.Debugf("acceptLocalRes: false: matched by ip %s", ip)
 				return false
 			default: // policyMissing
 				continue
@@ -584,6 +936,22 @@ func (d *Dispatcher) acceptLocalRes(res *dns.Msg, requestLogger *logrus.Entry) (
 	return true
 }
 
+// acceptRemoteRes checks the ips in res from the remote server with the remote ip policies ps.
+func (d *Dispatcher) acceptRemoteRes(res *dns.Msg, ps *ipPolicies, requestLogger *logrus.Entry) (ok bool) {
+	for _, ip := range answerIPs(res) {
+		switch ps.check(ip) {
+		case policyActionAccept:
+			requestLogger.Debugf("acceptRemoteRes: true: matched by ip %s", ip)
+			return true
+		case policyActionDeny:
+			requestLogger.Debugf("acceptRemoteRes: false: matched by ip %s", ip)
+			return false
+		}
+	}
+	requestLogger.Debug("acceptRemoteRes: true: default accept")
+	return true
+}
+
 func caPath2Pool(ca string) (*x509.CertPool, error) {
 	pem, err := ioutil.ReadFile(ca)
 	if err != nil {
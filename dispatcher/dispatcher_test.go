@@ -25,11 +25,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/cache"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
 
 	"github.com/sirupsen/logrus"
 
-	netlist "github.com/IrineSistiana/net-list"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
 
 	"github.com/miekg/dns"
 )
@@ -45,7 +46,7 @@ func Test_dispatcher(t *testing.T) {
 
 		q := new(dns.Msg)
 		q.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-		r, err := d.ServeDNS(context.Background(), q)
+		r, err := d.ServeDNS(context.Background(), nil, q)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -137,18 +138,19 @@ func initTestDispatcherAndServer(lLatency, rLatency time.Duration, lIP, rIP net.
 
 	d.local.client = &fakeUpstream{latency: lLatency, ip: lIP}
 	d.remote.client = &fakeUpstream{latency: rLatency, ip: rIP}
+	d.defaultRoute = d.newDefaultRoute()
 
 	return d, nil
 }
 
 // deny -> accept -> deny all
 func genTestIPPolicies(accept, deny string) *ipPolicies {
-	acceptList, err := netlist.NewListFromReader(bytes.NewReader([]byte(accept)))
+	acceptList, err := iptrie.LoadFromReader(bytes.NewReader([]byte(accept)))
 	if err != nil {
 		panic(err.Error)
 	}
 
-	denyList, err := netlist.NewListFromReader(bytes.NewReader([]byte(deny)))
+	denyList, err := iptrie.LoadFromReader(bytes.NewReader([]byte(deny)))
 	if err != nil {
 		panic(err.Error)
 	}
@@ -194,3 +196,90 @@ const (
 	wantLocal uint8 = iota
 	wantRemote
 )
+
+func Test_queryTimeout(t *testing.T) {
+	c := new(Config)
+	c.Server.Local.Addr = "127.0.0.1:53"
+	c.Server.Remote.Addr = "127.0.0.1:53"
+	if got := queryTimeout(c); got != defaultUpstreamTimeout {
+		t.Fatalf("want %s, got %s", defaultUpstreamTimeout, got)
+	}
+
+	c.Server.Local.Timeout = 5000
+	c.Server.Remote.Timeout = 1000
+	c.Server.Remote.DelayStart = 100
+	if got := queryTimeout(c); got != time.Second*5 {
+		t.Fatalf("want 5s, got %s", got)
+	}
+	c.Server.Remote.Timeout = 6000
+	if got := queryTimeout(c); got != time.Millisecond*6100 {
+		t.Fatalf("want 6.1s, got %s", got)
+	}
+	c.ClientGroups = make([]ClientGroupConfig, 1)
+	c.ClientGroups[0].Remote.Addr = "127.0.0.1:53"
+	c.ClientGroups[0].Remote.Timeout = 8000
+	if got := queryTimeout(c); got != time.Second*8 {
+		t.Fatalf("want 8s, got %s", got)
+	}
+}
+
+func Test_dispatcher_tryAddToCache(t *testing.T) {
+	d := new(Dispatcher)
+	d.cache.Cache = cache.New(8)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Truncated = true
+	d.tryAddToCache(d.cache.Cache, r)
+	if d.tryGetFromCache(d.cache.Cache, q) != nil {
+		t.Fatal("truncated reply should not be cached")
+	}
+
+	r.Truncated = false
+	d.tryAddToCache(d.cache.Cache, r)
+	if d.tryGetFromCache(d.cache.Cache, q) == nil {
+		t.Fatal("reply should be cached")
+	}
+}
+
+func Test_dispatcher_remoteIPPolicies(t *testing.T) {
+	tests := []struct {
+		name         string
+		servfail     bool
+		doPo         *domainPolicies
+		wantServfail bool
+	}{
+		{"wait", false, nil, false},
+		{"servfail", true, nil, true},
+		{"wait without local", false, genTestDomainPolicies("", "", "com"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := initTestDispatcherAndServer(time.Millisecond*50, 0, ip("0.0.0.1"), ip("192.168.1.1"), nil, tt.doPo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.remote.ipPolicies = genTestIPPolicies("", "192.168.0.0/16")
+			d.defaultRoute = d.newDefaultRoute()
+			d.remote.servfailOnDeny = tt.servfail
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, err := d.ServeDNS(context.Background(), nil, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantServfail {
+				if r.Rcode != dns.RcodeServerFailure {
+					t.Fatalf("want SERVFAIL, got %v", r)
+				}
+				return
+			}
+			if !r.Answer[0].(*dns.A).A.Equal(ip("0.0.0.1")) {
+				t.Fatalf("denied remote result should be dropped, got %v", r.Answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,777 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecStatus is the result of the DNSSEC validation of a reply.
+// See RFC 4035 4.3.
+type dnssecStatus uint8
+
+const (
+	dnssecUnchecked dnssecStatus = iota // validation is disabled or skipped
+	dnssecInsecure
+	dnssecSecure
+	dnssecBogus
+)
+
+func (s dnssecStatus) String() string {
+	switch s {
+	case dnssecInsecure:
+		return "insecure"
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	default:
+		return "unchecked"
+	}
+}
+
+const (
+	dnssecMinCacheTTL  = time.Second * 10
+	dnssecMaxCacheTTL  = time.Hour
+	dnssecMaxCacheSize = 4096
+)
+
+// rootTrustAnchor is the DS record of the root KSK-2017.
+// See https://data.iana.org/root-anchors/root-anchors.xml
+const rootTrustAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+var errDNSSECNoProof = errors.New("no valid denial of existence")
+
+// dnssecValidator validates replies by building chains of trust from the
+// trust anchors. DS and DNSKEY records are fetched from the upstream that
+// sent the reply.
+type dnssecValidator struct {
+	anchors map[string][]dns.RR // zone -> DS and DNSKEY records
+
+	sync.Mutex
+	zones map[string]*dnssecZone // name -> the zone that the name belongs to
+}
+
+// dnssecZone describes the zone that a name belongs to.
+type dnssecZone struct {
+	status dnssecStatus
+	zone   string
+	keys   []*dns.DNSKEY // validated keys of zone, only if status is dnssecSecure
+	expire time.Time
+}
+
+// newDNSSECValidator returns a dnssecValidator. anchors are DS or DNSKEY
+// records in presentation format. If anchors is empty, the root KSK is used.
+func newDNSSECValidator(anchors []string) (*dnssecValidator, error) {
+	if len(anchors) == 0 {
+		anchors = []string{rootTrustAnchor}
+	}
+	v := &dnssecValidator{
+		anchors: make(map[string][]dns.RR),
+		zones:   make(map[string]*dnssecZone),
+	}
+	for _, s := range anchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor [%s]: %w", s, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("invalid trust anchor [%s]: not a DS or DNSKEY record", s)
+		}
+		zone := canonicalName(rr.Header().Name)
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+	return v, nil
+}
+
+// validate validates r, the reply of q from u, and sets the AD bit of r
+// if r is secure.
+func (v *dnssecValidator) validate(ctx context.Context, u Upstream, q, r *dns.Msg) (dnssecStatus, error) {
+	r.AuthenticatedData = false
+	if len(q.Question) != 1 || (r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError) {
+		return dnssecInsecure, nil
+	}
+
+	var status dnssecStatus
+	var err error
+	if len(r.Answer) != 0 && r.Rcode == dns.RcodeSuccess {
+		status, err = v.validateAnswer(ctx, u, r)
+	} else {
+		status, err = v.validateNegative(ctx, u, q.Question[0], r)
+	}
+	if status == dnssecSecure {
+		r.AuthenticatedData = true
+	}
+	return status, err
+}
+
+func (v *dnssecValidator) validateAnswer(ctx context.Context, u Upstream, r *dns.Msg) (dnssecStatus, error) {
+	sets := splitRRsets(r.Answer)
+	status := dnssecSecure
+	for _, set := range sets {
+		s, err := v.validateRRset(ctx, u, set)
+		if err != nil {
+			return dnssecBogus, fmt.Errorf("%s %s: %w", set.name, dns.TypeToString[set.rrtype], err)
+		}
+		if s == dnssecInsecure {
+			status = dnssecInsecure
+			continue
+		}
+
+		// The answer is expanded from a wildcard, there must be a proof
+		// that the name itself does not exist. See RFC 4035 5.3.4.
+		if labels := uint8(dns.CountLabel(set.name)); set.sigs[0].Labels < labels {
+			zone, err := v.findZone(ctx, u, set.sigs[0].SignerName)
+			if err != nil {
+				return dnssecBogus, err
+			}
+			var proofs []*rrset
+			for _, nsSet := range splitRRsets(r.Ns) {
+				if _, ok := verifyRRset(nsSet, zone.zone, zone.keys); ok {
+					proofs = append(proofs, nsSet)
+				}
+			}
+			nextCloser := lastLabels(set.name, int(set.sigs[0].Labels)+1)
+			if !hasCoverProof(proofs, set.name, nextCloser) {
+				return dnssecBogus, fmt.Errorf("%s: wildcard answer without %w", set.name, errDNSSECNoProof)
+			}
+		}
+	}
+	return status, nil
+}
+
+func (v *dnssecValidator) validateNegative(ctx context.Context, u Upstream, question dns.Question, r *dns.Msg) (dnssecStatus, error) {
+	qname := canonicalName(question.Name)
+	sets := splitRRsets(r.Ns)
+
+	var signer string
+	for _, set := range sets {
+		if len(set.sigs) != 0 {
+			signer = set.sigs[0].SignerName
+			break
+		}
+	}
+	if len(signer) == 0 { // unsigned, the name must be in an insecure zone.
+		zone, err := v.findZone(ctx, u, qname)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if zone.status == dnssecSecure {
+			return dnssecBogus, fmt.Errorf("%s: unsigned negative reply from secure zone %s", qname, zone.zone)
+		}
+		return zone.status, nil
+	}
+
+	for _, set := range sets {
+		s, err := v.validateRRset(ctx, u, set)
+		if err != nil {
+			return dnssecBogus, fmt.Errorf("%s %s: %w", set.name, dns.TypeToString[set.rrtype], err)
+		}
+		if s == dnssecInsecure {
+			return dnssecInsecure, nil
+		}
+	}
+
+	zone, err := v.findZone(ctx, u, signer)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if r.Rcode == dns.RcodeNameError {
+		if !hasNXDomainProof(sets, zone, qname) {
+			return dnssecBogus, fmt.Errorf("%s: nxdomain without %w", qname, errDNSSECNoProof)
+		}
+		return dnssecSecure, nil
+	}
+
+	typ, optOut := denialTypes(sets, qname)
+	switch {
+	case typ == nil && optOut:
+		return dnssecInsecure, nil
+	case typ == nil:
+		return dnssecBogus, fmt.Errorf("%s: nodata without %w", qname, errDNSSECNoProof)
+	case hasType(typ, question.Qtype) || hasType(typ, dns.TypeCNAME):
+		return dnssecBogus, fmt.Errorf("%s: nodata but type exists in NSEC/NSEC3", qname)
+	}
+	return dnssecSecure, nil
+}
+
+// validateRRset validates a signed or unsigned rrset.
+func (v *dnssecValidator) validateRRset(ctx context.Context, u Upstream, set *rrset) (dnssecStatus, error) {
+	if len(set.sigs) == 0 {
+		zone, err := v.findZone(ctx, u, set.name)
+		if err != nil {
+			return dnssecBogus, err
+		}
+		if zone.status == dnssecSecure {
+			return dnssecBogus, fmt.Errorf("missing RRSIG from secure zone %s", zone.zone)
+		}
+		return zone.status, nil
+	}
+
+	signer := canonicalName(set.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, set.name) {
+		return dnssecBogus, fmt.Errorf("signer %s is not a parent of the rrset", signer)
+	}
+	zone, err := v.findZone(ctx, u, signer)
+	if err != nil {
+		return dnssecBogus, err
+	}
+	if zone.status != dnssecSecure {
+		return zone.status, nil
+	}
+	if zone.zone != signer {
+		return dnssecBogus, fmt.Errorf("signer %s is not a zone apex", signer)
+	}
+	if _, ok := verifyRRset(set, zone.zone, zone.keys); !ok {
+		return dnssecBogus, fmt.Errorf("no valid RRSIG from zone %s", zone.zone)
+	}
+	return dnssecSecure, nil
+}
+
+// findZone returns the zone that name belongs to. It walks from the closest
+// trust anchor down to name and checks each delegation.
+func (v *dnssecValidator) findZone(ctx context.Context, u Upstream, name string) (*dnssecZone, error) {
+	name = canonicalName(name)
+
+	var anchor string
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) >= dns.CountLabel(anchor) {
+			anchor = zone
+		}
+	}
+	if len(anchor) == 0 { // not under any trust anchor
+		return &dnssecZone{status: dnssecInsecure}, nil
+	}
+
+	cur := v.getZone(anchor)
+	if cur == nil {
+		var err error
+		if cur, err = v.anchorZone(ctx, u, anchor); err != nil {
+			return nil, err
+		}
+		v.putZone(anchor, cur)
+	}
+
+	anchorLabels := dns.CountLabel(anchor)
+	nameLabels := dns.CountLabel(name)
+	for i := anchorLabels + 1; i <= nameLabels; i++ {
+		if cur.status != dnssecSecure {
+			return cur, nil
+		}
+		child := lastLabels(name, i)
+		if z := v.getZone(child); z != nil {
+			cur = z
+			continue
+		}
+		z, err := v.delegation(ctx, u, cur, child)
+		if err != nil {
+			return nil, err
+		}
+		v.putZone(child, z)
+		cur = z
+	}
+	return cur, nil
+}
+
+// anchorZone fetches and validates the keys of a trust anchor.
+func (v *dnssecValidator) anchorZone(ctx context.Context, u Upstream, anchor string) (*dnssecZone, error) {
+	keys, ttl, err := v.fetchKeys(ctx, u, anchor, func(k *dns.DNSKEY) bool {
+		for _, rr := range v.anchors[anchor] {
+			switch a := rr.(type) {
+			case *dns.DS:
+				if dsMatch(a, k) {
+					return true
+				}
+			case *dns.DNSKEY:
+				if a.Algorithm == k.Algorithm && a.Flags == k.Flags && a.PublicKey == k.PublicKey {
+					return true
+				}
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("trust anchor %s: %w", anchor, err)
+	}
+	return newDNSSECZone(dnssecSecure, anchor, keys, ttl), nil
+}
+
+// delegation checks whether child is a zone cut under parent, and returns
+// the zone that child belongs to.
+func (v *dnssecValidator) delegation(ctx context.Context, u Upstream, parent *dnssecZone, child string) (*dnssecZone, error) {
+	r, err := v.query(ctx, u, child, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		for _, set := range splitRRsets(r.Answer) {
+			if set.name != child {
+				continue
+			}
+			ttl, ok := verifyRRset(set, parent.zone, parent.keys)
+			if !ok {
+				return nil, fmt.Errorf("%s %s: no valid RRSIG from zone %s", child, dns.TypeToString[set.rrtype], parent.zone)
+			}
+			if set.rrtype != dns.TypeDS { // e.g. CNAME, it is not a zone cut.
+				return newDNSSECZone(dnssecSecure, parent.zone, parent.keys, ttl), nil
+			}
+			return v.childZone(ctx, u, child, set.rrs, ttl)
+		}
+	case dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("%s DS: rcode %s", child, dns.RcodeToString[r.Rcode])
+	}
+
+	// no DS, find out whether it is an insecure delegation.
+	sets := splitRRsets(r.Ns)
+	ttl := uint32(dnssecMaxCacheTTL / time.Second)
+	for _, set := range sets {
+		t, ok := verifyRRset(set, parent.zone, parent.keys)
+		if !ok {
+			return nil, fmt.Errorf("%s DS: %s %s: no valid RRSIG from zone %s", child, set.name, dns.TypeToString[set.rrtype], parent.zone)
+		}
+		if t < ttl {
+			ttl = t
+		}
+	}
+	if r.Rcode == dns.RcodeNameError {
+		if !hasNXDomainProof(sets, parent, child) {
+			return nil, fmt.Errorf("%s DS: nxdomain without %w", child, errDNSSECNoProof)
+		}
+		return newDNSSECZone(dnssecSecure, parent.zone, parent.keys, ttl), nil
+	}
+
+	typ, optOut := denialTypes(sets, child)
+	switch {
+	case typ == nil && optOut:
+		return newDNSSECZone(dnssecInsecure, child, nil, ttl), nil
+	case typ == nil:
+		return nil, fmt.Errorf("%s DS: nodata without %w", child, errDNSSECNoProof)
+	case hasType(typ, dns.TypeDS):
+		return nil, fmt.Errorf("%s DS: nodata but DS exists in NSEC/NSEC3", child)
+	case hasType(typ, dns.TypeNS) && !hasType(typ, dns.TypeSOA):
+		return newDNSSECZone(dnssecInsecure, child, nil, ttl), nil
+	default: // not a zone cut
+		return newDNSSECZone(dnssecSecure, parent.zone, parent.keys, ttl), nil
+	}
+}
+
+// childZone validates the keys of child with its validated DS records.
+func (v *dnssecValidator) childZone(ctx context.Context, u Upstream, child string, dsSet []dns.RR, dsTTL uint32) (*dnssecZone, error) {
+	var supported bool
+	for _, rr := range dsSet {
+		if ds, ok := rr.(*dns.DS); ok && dnssecSupported(ds.Algorithm, ds.DigestType) {
+			supported = true
+		}
+	}
+	if !supported { // RFC 4035 5.2, treat it as unsigned.
+		return newDNSSECZone(dnssecInsecure, child, nil, dsTTL), nil
+	}
+
+	keys, ttl, err := v.fetchKeys(ctx, u, child, func(k *dns.DNSKEY) bool {
+		for _, rr := range dsSet {
+			if ds, ok := rr.(*dns.DS); ok && dsMatch(ds, k) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", child, err)
+	}
+	if dsTTL < ttl {
+		ttl = dsTTL
+	}
+	return newDNSSECZone(dnssecSecure, child, keys, ttl), nil
+}
+
+// fetchKeys fetches the DNSKEY rrset of zone. The rrset must be signed by
+// a key that trusted returns true.
+func (v *dnssecValidator) fetchKeys(ctx context.Context, u Upstream, zone string, trusted func(k *dns.DNSKEY) bool) ([]*dns.DNSKEY, uint32, error) {
+	r, err := v.query(ctx, u, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, set := range splitRRsets(r.Answer) {
+		if set.name != zone || set.rrtype != dns.TypeDNSKEY {
+			continue
+		}
+		var keys, trustedKeys []*dns.DNSKEY
+		for _, rr := range set.rrs {
+			k := rr.(*dns.DNSKEY)
+			keys = append(keys, k)
+			if trusted(k) {
+				trustedKeys = append(trustedKeys, k)
+			}
+		}
+		ttl, ok := verifyRRset(set, zone, trustedKeys)
+		if !ok {
+			return nil, 0, errors.New("DNSKEY is not signed by a trusted key")
+		}
+		return keys, ttl, nil
+	}
+	return nil, 0, errors.New("no DNSKEY")
+}
+
+func (v *dnssecValidator) query(ctx context.Context, u Upstream, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, true)
+	q.CheckingDisabled = true
+	r, err := u.Exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	return r, nil
+}
+
+// hasNXDomainProof reports whether sets proves that name does not exist, and
+// no wildcard at the closest encloser could have synthesized it.
+// sets must be validated.
+func hasNXDomainProof(sets []*rrset, zone *dnssecZone, name string) bool {
+	// NSEC: a NSEC covers name, the closest encloser is the longest common
+	// ancestor of name and the owner or the next name. See RFC 4035 5.4.
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok || !nsecCover(nsec, name) {
+				continue
+			}
+			n := dns.CompareDomainName(name, nsec.Hdr.Name)
+			if m := dns.CompareDomainName(name, nsec.NextDomain); m > n {
+				n = m
+			}
+			if hasCoverProof(sets, wildcardName(lastLabels(name, n)), "") {
+				return true
+			}
+		}
+	}
+
+	// NSEC3: the closest encloser matches, the next closer name and
+	// the wildcard at the closest encloser are covered. See RFC 5155 8.4.
+	for i := dns.CountLabel(name); i > dns.CountLabel(zone.zone); i-- {
+		closestEncloser := lastLabels(name, i-1)
+		if hasCoverProof(sets, "", lastLabels(name, i)) && hasNSEC3Match(sets, closestEncloser) &&
+			hasCoverProof(sets, "", wildcardName(closestEncloser)) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardName returns the wildcard name at name, e.g. "*.example.".
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+// hasCoverProof reports whether sets has a NSEC that covers name or
+// a NSEC3 that covers nextCloser. Empty names are ignored.
+func hasCoverProof(sets []*rrset, name, nextCloser string) bool {
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			switch nsec := rr.(type) {
+			case *dns.NSEC:
+				if len(name) != 0 && nsecCover(nsec, name) {
+					return true
+				}
+			case *dns.NSEC3:
+				// Cover also returns true if the owner matches.
+				if len(nextCloser) != 0 && nsec.Cover(nextCloser) && !nsec.Match(nextCloser) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func hasNSEC3Match(sets []*rrset, name string) bool {
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// denialTypes returns the type bitmap of the NSEC/NSEC3 that matches name.
+// If no record matches name but a NSEC3 with the opt-out flag covers it,
+// optOut will be true.
+func denialTypes(sets []*rrset, name string) (types []uint16, optOut bool) {
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			switch nsec := rr.(type) {
+			case *dns.NSEC:
+				if canonicalName(nsec.Hdr.Name) == name {
+					return nsec.TypeBitMap, false
+				}
+			case *dns.NSEC3:
+				if nsec.Match(name) {
+					return nsec.TypeBitMap, false
+				}
+				if nsec.Flags&1 == 1 && nsec.Cover(name) {
+					optOut = true
+				}
+			}
+		}
+	}
+	return nil, optOut
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCover reports whether name is between the owner and the next name of nsec.
+func nsecCover(nsec *dns.NSEC, name string) bool {
+	owner := canonicalName(nsec.Hdr.Name)
+	next := canonicalName(nsec.NextDomain)
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// the last NSEC in the zone.
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare compares two canonical names in DNSSEC canonical order.
+// See RFC 4034 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(a)
+	lb := dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func (v *dnssecValidator) getZone(name string) *dnssecZone {
+	v.Lock()
+	defer v.Unlock()
+	z := v.zones[name]
+	if z != nil && time.Now().After(z.expire) {
+		delete(v.zones, name)
+		return nil
+	}
+	return z
+}
+
+func (v *dnssecValidator) putZone(name string, z *dnssecZone) {
+	v.Lock()
+	defer v.Unlock()
+	if len(v.zones) >= dnssecMaxCacheSize {
+		now := time.Now()
+		for k, z := range v.zones {
+			if now.After(z.expire) {
+				delete(v.zones, k)
+			}
+		}
+		if len(v.zones) >= dnssecMaxCacheSize {
+			v.zones = make(map[string]*dnssecZone)
+		}
+	}
+	v.zones[name] = z
+}
+
+func newDNSSECZone(status dnssecStatus, zone string, keys []*dns.DNSKEY, ttl uint32) *dnssecZone {
+	d := time.Duration(ttl) * time.Second
+	if d < dnssecMinCacheTTL {
+		d = dnssecMinCacheTTL
+	}
+	if d > dnssecMaxCacheTTL {
+		d = dnssecMaxCacheTTL
+	}
+	return &dnssecZone{status: status, zone: zone, keys: keys, expire: time.Now().Add(d)}
+}
+
+// rrset is a set of records with the same name and type, and their RRSIGs.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// splitRRsets groups rrs into rrsets. Names are canonical.
+func splitRRsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, t uint16) *rrset {
+		for _, set := range sets {
+			if set.name == name && set.rrtype == t {
+				return set
+			}
+		}
+		set := &rrset{name: name, rrtype: t}
+		sets = append(sets, set)
+		return set
+	}
+
+	for _, rr := range rrs {
+		name := canonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			set := find(name, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		case *dns.OPT:
+		default:
+			set := find(name, rr.Header().Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	// RRSIGs without records are useless.
+	valid := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) != 0 {
+			valid = append(valid, set)
+		}
+	}
+	return valid
+}
+
+// verifyRRset verifies set with keys of zone. It returns the min ttl of
+// the set and its valid RRSIG.
+func verifyRRset(set *rrset, zone string, keys []*dns.DNSKEY) (ttl uint32, ok bool) {
+	now := time.Now()
+	for _, sig := range set.sigs {
+		if canonicalName(sig.SignerName) != zone || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			// only zone keys can sign rrsets. See RFC 4034 2.1.1.
+			if k.Flags&dns.ZONE == 0 || k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(k, set.rrs); err != nil {
+				continue
+			}
+
+			ttl = sig.OrigTtl
+			for _, rr := range set.rrs {
+				if rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+			}
+			if left := int64(sig.Expiration) - now.Unix(); left < int64(ttl) {
+				ttl = uint32(left)
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+func dsMatch(ds *dns.DS, k *dns.DNSKEY) bool {
+	if ds.Algorithm != k.Algorithm || ds.KeyTag != k.KeyTag() || !dnssecSupported(ds.Algorithm, ds.DigestType) {
+		return false
+	}
+	kds := k.ToDS(ds.DigestType)
+	return kds != nil && strings.EqualFold(kds.Digest, ds.Digest)
+}
+
+func dnssecSupported(alg, digestType uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512, dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+	default:
+		return false
+	}
+	switch digestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// lastLabels returns the last n labels of name.
+func lastLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n <= 0 || len(idx) == 0 {
+		return "."
+	}
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+// setDO returns a copy of q with the DO bit set.
+func setDO(q *dns.Msg) *dns.Msg {
+	if opt := q.IsEdns0(); opt != nil && opt.Do() {
+		return q
+	}
+	qCopy := q.Copy()
+	if opt := qCopy.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		qCopy.SetEdns0(MaxUDPSize, true)
+	}
+	return qCopy
+}
+
+// stripDNSSECRecords removes DNSSEC records that the client didn't ask for.
+// See RFC 4035 3.2.1.
+func stripDNSSECRecords(q, r *dns.Msg) {
+	if opt := q.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+	var qtype uint16
+	if len(q.Question) == 1 {
+		qtype = q.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		s := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			s = append(s, rr)
+		}
+		return s
+	}
+	r.Answer = strip(r.Answer)
+	r.Ns = strip(r.Ns)
+}
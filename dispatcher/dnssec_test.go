@@ -0,0 +1,353 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/cache"
+	"github.com/miekg/dns"
+)
+
+// testSignedZone is a zone signed by a single ECDSA key.
+type testSignedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSignedZone(t *testing.T, name string) *testSignedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSignedZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrset and its RRSIG.
+func (z *testSignedZone) sign(t *testing.T, rrset ...dns.RR) []dns.RR {
+	h := rrset[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		Algorithm:   z.key.Algorithm,
+		OrigTtl:     h.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.key.KeyTag(),
+		SignerName:  z.name,
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrset, sig)
+}
+
+func mustNewRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// testRecordsUpstream replies queries with prepared records.
+type testRecordsUpstream map[string]*dns.Msg
+
+func (u testRecordsUpstream) set(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	u[fmt.Sprintf("%s %d", name, qtype)] = &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}, Answer: answer, Ns: ns}
+}
+
+func (u testRecordsUpstream) Exchange(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	m, ok := u[fmt.Sprintf("%s %d", q.Question[0].Name, q.Question[0].Qtype)]
+	if !ok {
+		return nil, fmt.Errorf("no record for %s", q.Question[0].String())
+	}
+	r := m.Copy()
+	r.SetRcode(q, m.Rcode)
+	r.Answer, r.Ns = m.Copy().Answer, m.Copy().Ns
+	return r, nil
+}
+
+// delayedUpstream delays every query to u.
+type delayedUpstream struct {
+	u     Upstream
+	delay time.Duration
+}
+
+func (u *delayedUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	time.Sleep(u.delay)
+	return u.u.Exchange(ctx, q)
+}
+
+// newTestDNSSECZones returns an upstream that serves these zones:
+//
+//	example. is the trust anchor.
+//	secure.example. is a signed zone, www.secure.example. has an A record.
+//	insecure.example. is an unsigned delegation.
+func newTestDNSSECZones(t *testing.T) (testRecordsUpstream, *dns.DS) {
+	root := newTestSignedZone(t, "example.")
+	secure := newTestSignedZone(t, "secure.example.")
+	u := make(testRecordsUpstream)
+
+	u.set("example.", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil)
+	secureDS := secure.key.ToDS(dns.SHA256)
+	secureDS.Hdr.Ttl = 3600
+	u.set("secure.example.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, secureDS), nil)
+	soa := root.sign(t, mustNewRR("example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))
+	nsec := root.sign(t, mustNewRR("insecure.example. 300 IN NSEC secure.example. NS RRSIG NSEC"))
+	u.set("insecure.example.", dns.TypeDS, dns.RcodeSuccess, nil, append(soa, nsec...))
+
+	u.set("secure.example.", dns.TypeDNSKEY, dns.RcodeSuccess, secure.sign(t, secure.key), nil)
+	u.set("www.secure.example.", dns.TypeA, dns.RcodeSuccess, secure.sign(t, mustNewRR("www.secure.example. 300 IN A 1.2.3.4")), nil)
+	// www.secure.example. is not a zone cut
+	soa = secure.sign(t, mustNewRR("secure.example. 3600 IN SOA ns.secure.example. admin.secure.example. 1 3600 600 86400 300"))
+	nsec = secure.sign(t, mustNewRR("www.secure.example. 300 IN NSEC secure.example. A RRSIG NSEC"))
+	u.set("www.secure.example.", dns.TypeDS, dns.RcodeSuccess, nil, append(soa, nsec...))
+	nsec = secure.sign(t, mustNewRR("secure.example. 300 IN NSEC www.secure.example. SOA RRSIG NSEC DNSKEY"))
+	u.set("nx.secure.example.", dns.TypeA, dns.RcodeNameError, nil, append(soa, nsec...))
+
+	u.set("www.insecure.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustNewRR("www.insecure.example. 300 IN A 1.2.3.4")}, nil)
+
+	return u, root.key.ToDS(dns.SHA256)
+}
+
+func Test_dnssecValidator(t *testing.T) {
+	u, anchor := newTestDNSSECZones(t)
+
+	tests := []struct {
+		name   string
+		qname  string
+		modify func(r *dns.Msg)
+		want   dnssecStatus
+	}{
+		{"secure", "www.secure.example.", nil, dnssecSecure},
+		{"secure nxdomain", "nx.secure.example.", nil, dnssecSecure},
+		{"insecure", "www.insecure.example.", nil, dnssecInsecure},
+		{"tampered", "www.secure.example.", func(r *dns.Msg) { r.Answer[0].(*dns.A).A = net.IPv4(5, 6, 7, 8) }, dnssecBogus},
+		{"unsigned", "www.secure.example.", func(r *dns.Msg) { r.Answer = r.Answer[:1] }, dnssecBogus},
+		{"nxdomain without proof", "nx.secure.example.", func(r *dns.Msg) { r.Ns = r.Ns[:2] }, dnssecBogus},
+		{"forged nxdomain", "www.secure.example.", func(r *dns.Msg) {
+			// the NSEC of nx.secure.example. doesn't cover www.secure.example.
+			r.Rcode = dns.RcodeNameError
+			r.Answer = nil
+			r.Ns = u[fmt.Sprintf("nx.secure.example. %d", dns.TypeA)].Copy().Ns
+		}, dnssecBogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newDNSSECValidator([]string{anchor.String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeA)
+			r, err := u.Exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.modify != nil {
+				tt.modify(r)
+			}
+			got, err := v.validate(context.Background(), u, q, r)
+			if got != tt.want {
+				t.Fatalf("want %s, got %s, err: %v", tt.want, got, err)
+			}
+			if r.AuthenticatedData != (got == dnssecSecure) {
+				t.Fatalf("invalid AD bit: %v", r.AuthenticatedData)
+			}
+		})
+	}
+}
+
+func Test_dispatcher_dnssec(t *testing.T) {
+	u, anchor := newTestDNSSECZones(t)
+	bogus := make(testRecordsUpstream)
+	for k, m := range u {
+		bogus[k] = m
+	}
+	bogus.set("www.secure.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{mustNewRR("www.secure.example. 300 IN A 5.6.7.8")}, nil)
+	bogus[fmt.Sprintf("www.secure.example. %d", dns.TypeA)].AuthenticatedData = true // a lying upstream
+
+	d, err := initTestDispatcherAndServer(0, 0, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ecs.local, d.ecs.remote = nil, nil
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.secure.example.", dns.TypeA)
+
+	// validation is disabled, the AD bit from upstreams is kept.
+	d.local.client, d.remote.client = bogus, nil
+	d.defaultRoute = d.newDefaultRoute()
+	r, err := d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.AuthenticatedData {
+		t.Fatalf("want the AD bit from upstream, got %v", r)
+	}
+
+	if d.dnssec, err = newDNSSECValidator([]string{anchor.String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// bogus local result should be denied.
+	d.local.client, d.remote.client = bogus, u
+	d.defaultRoute = d.newDefaultRoute()
+	r, err = d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.AuthenticatedData || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(ip("1.2.3.4")) {
+		t.Fatalf("want secure result from remote, got %v", r)
+	}
+
+	// replies to CD queries are not validated and not cached.
+	d.cache.Cache = cache.New(8)
+	d.local.client, d.remote.client = bogus, nil
+	d.defaultRoute = d.newDefaultRoute()
+	qCD := q.Copy()
+	qCD.CheckingDisabled = true
+	r, err = d.ServeDNS(context.Background(), nil, qCD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.AuthenticatedData || !r.Answer[0].(*dns.A).A.Equal(ip("5.6.7.8")) {
+		t.Fatalf("want the unvalidated result without AD, got %v", r)
+	}
+	d.local.client, d.remote.client = bogus, u
+	d.defaultRoute = d.newDefaultRoute()
+	r, err = d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.AuthenticatedData || !r.Answer[0].(*dns.A).A.Equal(ip("1.2.3.4")) {
+		t.Fatalf("want secure result from remote, got %v", r)
+	}
+	d.cache.Cache = nil
+
+	// bogus remote result should be skipped, even if it is faster.
+	d.local.client, d.remote.client = &delayedUpstream{u: u, delay: time.Millisecond * 50}, bogus
+	d.defaultRoute = d.newDefaultRoute()
+	r, err = d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.AuthenticatedData || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(ip("1.2.3.4")) {
+		t.Fatalf("want secure result from local, got %v", r)
+	}
+
+	// both results are bogus.
+	d.local.client, d.remote.client = bogus, bogus
+	d.defaultRoute = d.newDefaultRoute()
+	r, err = d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want SERVFAIL, got %v", r)
+	}
+
+	// no one else can answer it.
+	d.remote.client = nil
+	d.defaultRoute = d.newDefaultRoute()
+	r, err = d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want SERVFAIL, got %v", r)
+	}
+}
+
+func Test_hasNXDomainProof(t *testing.T) {
+	zone := &dnssecZone{zone: "example."}
+	// nsec3Chain returns the NSEC3 chain of names.
+	nsec3Chain := func(names ...string) []dns.RR {
+		hashes := make([]string, 0, len(names))
+		for _, name := range names {
+			hashes = append(hashes, dns.HashName(name, dns.SHA1, 0, ""))
+		}
+		sort.Strings(hashes)
+		rrs := make([]dns.RR, 0, len(hashes))
+		for i, h := range hashes {
+			rrs = append(rrs, &dns.NSEC3{
+				Hdr:        dns.RR_Header{Name: h + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+				Hash:       dns.SHA1,
+				HashLength: 20,
+				NextDomain: hashes[(i+1)%len(hashes)],
+				TypeBitMap: []uint16{dns.TypeA},
+			})
+		}
+		return rrs
+	}
+
+	tests := []struct {
+		name string
+		rrs  []dns.RR
+		want bool
+	}{
+		{"nsec", []dns.RR{
+			mustNewRR("example. 300 IN NSEC www.example. SOA RRSIG NSEC DNSKEY"),
+		}, true},
+		// the NSEC covers nx.example., but *.example. exists.
+		{"nsec wildcard", []dns.RR{
+			mustNewRR("*.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+		}, false},
+		{"nsec wildcard with apex", []dns.RR{
+			mustNewRR("example. 300 IN NSEC *.example. SOA RRSIG NSEC DNSKEY"),
+			mustNewRR("*.example. 300 IN NSEC www.example. A RRSIG NSEC"),
+		}, false},
+		{"nsec3", nsec3Chain("example.", "www.example."), true},
+		{"nsec3 wildcard", nsec3Chain("example.", "*.example.", "www.example."), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasNXDomainProof(splitRRsets(tt.rrs), zone, "nx.example."); got != tt.want {
+				t.Fatalf("hasNXDomainProof() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_verifyRRset_zoneKey(t *testing.T) {
+	z := newTestSignedZone(t, "example.")
+	a := mustNewRR("www.example. 300 IN A 1.2.3.4")
+	if _, ok := verifyRRset(splitRRsets(z.sign(t, a))[0], "example.", []*dns.DNSKEY{z.key}); !ok {
+		t.Fatal("rrset signed by a zone key should be valid")
+	}
+
+	z.key.Flags = 0 // not a zone key
+	if _, ok := verifyRRset(splitRRsets(z.sign(t, a))[0], "example.", []*dns.DNSKEY{z.key}); ok {
+		t.Fatal("rrset signed by a non-zone key should be invalid")
+	}
+}
@@ -18,88 +18,241 @@
 package domainlist
 
 import (
+	"regexp"
+	"strings"
+
 	"github.com/miekg/dns"
 )
 
+// MatchType is the match kind of a Rule.
+type MatchType uint8
+
+const (
+	// MatchDomain matches the domain and all its sub domains.
+	MatchDomain MatchType = iota
+	// MatchFull matches the domain only.
+	MatchFull
+	// MatchKeyword matches domains that contain the keyword.
+	MatchKeyword
+	// MatchRegexp matches domains that match the regular expression.
+	MatchRegexp
+)
+
+var matchTypePrefix = [...]string{
+	MatchDomain:  "domain",
+	MatchFull:    "full",
+	MatchKeyword: "keyword",
+	MatchRegexp:  "regexp",
+}
+
+func (t MatchType) String() string {
+	if int(t) < len(matchTypePrefix) {
+		return matchTypePrefix[t]
+	}
+	return "unknown"
+}
+
+// Rule is a rule in the List.
+type Rule struct {
+	Type  MatchType
+	Value string
+}
+
+// String returns the rule in the same format as it is in a list file. e.g. "full:example.com."
+func (r Rule) String() string {
+	return r.Type.String() + ":" + r.Value
+}
+
+type regexpRule struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+// List is a domain list that supports domain(suffix), full, keyword and regexp rules.
+// domain and full rules are stored in hash tables. keyword and regexp rules are checked one by one.
 type List struct {
+	domain  *fqdnSet
+	full    *fqdnSet
+	keyword []string
+	regexp  []regexpRule
+}
+
+func New() *List {
+	return &List{
+		domain: newFqdnSet(),
+		full:   newFqdnSet(),
+	}
+}
+
+// Add adds a domain rule. fqdn must be a fqdn.
+func (l *List) Add(fqdn string) {
+	l.domain.add(fqdn)
+}
+
+// AddFull adds a full rule. fqdn must be a fqdn.
+func (l *List) AddFull(fqdn string) {
+	l.full.add(fqdn)
+}
+
+// AddKeyword adds a keyword rule.
+func (l *List) AddKeyword(keyword string) {
+	l.keyword = append(l.keyword, keyword)
+}
+
+// AddRegexp adds a regexp rule. expr will be matched against
+// the domain without the trailing dot. e.g. "example.com".
+func (l *List) AddRegexp(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	l.regexp = append(l.regexp, regexpRule{expr: expr, re: re})
+	return nil
+}
+
+// Has reports whether fqdn is matched by any rule in the list.
+func (l *List) Has(fqdn string) bool {
+	_, ok := l.Match(fqdn)
+	return ok
+}
+
+// Match returns the first rule that matches fqdn.
+// Rules are checked in this order: full, domain, keyword, regexp.
+func (l *List) Match(fqdn string) (Rule, bool) {
+	if fqdn == "." {
+		return Rule{}, false
+	}
+
+	if l.full.has(fqdn) {
+		return Rule{Type: MatchFull, Value: fqdn}, true
+	}
+
+	if l.domain.len() != 0 {
+		idx := make([]int, 1, 6)
+		off := 0
+		end := false
+
+		for {
+			off, end = dns.NextLabel(fqdn, off)
+			if end {
+				break
+			}
+			idx = append(idx, off)
+		}
+
+		for i := range idx {
+			p := idx[len(idx)-1-i]
+			if l.domain.has(fqdn[p:]) {
+				return Rule{Type: MatchDomain, Value: fqdn[p:]}, true
+			}
+		}
+	}
+
+	if len(l.keyword) == 0 && len(l.regexp) == 0 {
+		return Rule{}, false
+	}
+
+	domain := strings.TrimSuffix(fqdn, ".")
+	for _, k := range l.keyword {
+		if strings.Contains(domain, k) {
+			return Rule{Type: MatchKeyword, Value: k}, true
+		}
+	}
+
+	for _, r := range l.regexp {
+		if r.re.MatchString(domain) {
+			return Rule{Type: MatchRegexp, Value: r.expr}, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Len returns the number of rules in the list.
+func (l *List) Len() int {
+	return l.domain.len() + l.full.len() + len(l.keyword) + len(l.regexp)
+}
+
+// Walk calls f for every rule in l.
+func (l *List) Walk(f func(r Rule)) {
+	l.full.walk(func(fqdn string) { f(Rule{Type: MatchFull, Value: fqdn}) })
+	l.domain.walk(func(fqdn string) { f(Rule{Type: MatchDomain, Value: fqdn}) })
+	for _, k := range l.keyword {
+		f(Rule{Type: MatchKeyword, Value: k})
+	}
+	for _, r := range l.regexp {
+		f(Rule{Type: MatchRegexp, Value: r.expr})
+	}
+}
+
+// fqdnSet is a hash set for fqdn. Different lengths of fqdn
+// are stored in different fixed size array maps.
+type fqdnSet struct {
 	s map[[16]byte]struct{}
 	m map[[32]byte]struct{}
 	l map[[256]byte]struct{}
 }
 
-func New() *List {
-	return &List{
+func newFqdnSet() *fqdnSet {
+	return &fqdnSet{
 		s: make(map[[16]byte]struct{}),
 		m: make(map[[32]byte]struct{}),
 		l: make(map[[256]byte]struct{}),
 	}
 }
 
-func (l *List) Add(fqdn string) {
+func (s *fqdnSet) add(fqdn string) {
 	n := len(fqdn)
 
 	switch {
 	case n <= 16:
 		var b [16]byte
 		copy(b[:], fqdn)
-		l.s[b] = struct{}{}
+		s.s[b] = struct{}{}
 	case n <= 32:
 		var b [32]byte
 		copy(b[:], fqdn)
-		l.m[b] = struct{}{}
+		s.m[b] = struct{}{}
 	default:
 		var b [256]byte
 		copy(b[:], fqdn)
-		l.l[b] = struct{}{}
-	}
-}
-
-func (l *List) Has(fqdn string) bool {
-	if fqdn == "." {
-		return false
-	}
-	idx := make([]int, 1, 6)
-	off := 0
-	end := false
-
-	for {
-		off, end = dns.NextLabel(fqdn, off)
-		if end {
-			break
-		}
-		idx = append(idx, off)
+		s.l[b] = struct{}{}
 	}
-
-	for i := range idx {
-		p := idx[len(idx)-1-i]
-		if l.has(fqdn[p:]) {
-			return true
-		}
-	}
-	return false
 }
 
-func (l *List) has(fqdn string) bool {
+func (s *fqdnSet) has(fqdn string) bool {
 	n := len(fqdn)
 	switch {
 	case n <= 16:
 		var b [16]byte
 		copy(b[:], fqdn)
-		_, ok := l.s[b]
+		_, ok := s.s[b]
 		return ok
 	case n <= 32:
 		var b [32]byte
 		copy(b[:], fqdn)
-		_, ok := l.m[b]
+		_, ok := s.m[b]
 		return ok
 	default:
 		var b [256]byte
 		copy(b[:], fqdn)
-		_, ok := l.l[b]
+		_, ok := s.l[b]
 		return ok
 	}
 }
 
-func (l *List) Len() int {
-	return len(l.l) + len(l.m) + len(l.s)
+func (s *fqdnSet) len() int {
+	return len(s.l) + len(s.m) + len(s.s)
+}
+
+func (s *fqdnSet) walk(f func(fqdn string)) {
+	// keys are zero padded, fqdn never contains zero bytes.
+	for b := range s.s {
+		f(strings.TrimRight(string(b[:]), "\x00"))
+	}
+	for b := range s.m {
+		f(strings.TrimRight(string(b[:]), "\x00"))
+	}
+	for b := range s.l {
+		f(strings.TrimRight(string(b[:]), "\x00"))
+	}
 }
@@ -18,6 +18,7 @@
 package domainlist
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -41,6 +42,58 @@ func Test_DomainList(t *testing.T) {
 	assertTrue(l.Has("abc.abc.com."))
 }
 
+func Test_DomainListMatch(t *testing.T) {
+	list := `
+# comment
+cn
+domain:a.com
+full:b.com
+keyword:google
+regexp:^[a-z]+\.example\.org$
+full:c.com @cn
+`
+	l, err := LoadFormReader(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 6 {
+		t.Fatalf("want 6 rules, got %d", l.Len())
+	}
+
+	tests := []struct {
+		fqdn   string
+		want   string
+		wantOk bool
+	}{
+		{"a.cn.", "domain:cn.", true},
+		{"a.com.", "domain:a.com.", true},
+		{"sub.a.com.", "domain:a.com.", true},
+		{"b.com.", "full:b.com.", true},
+		{"sub.b.com.", "", false},
+		{"c.com.", "full:c.com.", true},
+		{"www.google.co.jp.", "keyword:google", true},
+		{"www.example.org.", "regexp:^[a-z]+\\.example\\.org$", true},
+		{"a.www.example.org.", "", false},
+		{"example.net.", "", false},
+		{".", "", false},
+	}
+	for _, tt := range tests {
+		r, ok := l.Match(tt.fqdn)
+		if ok != tt.wantOk {
+			t.Fatalf("%s: want ok %v, got %v", tt.fqdn, tt.wantOk, ok)
+		}
+		if ok && r.String() != tt.want {
+			t.Fatalf("%s: want rule %s, got %s", tt.fqdn, tt.want, r)
+		}
+	}
+
+	for _, s := range []string{"unknown:a.com", "full:", "regexp:[", "a..com"} {
+		if _, err := LoadFormReader(strings.NewReader(s)); err == nil {
+			t.Fatalf("invalid rule [%s] was loaded", s)
+		}
+	}
+}
+
 func assertTrue(b bool) {
 	if !b {
 		panic("assert failed")
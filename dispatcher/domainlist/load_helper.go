@@ -27,6 +27,7 @@ import (
 	"github.com/miekg/dns"
 )
 
+// LoadFormFile loads a domain list from file.
 func LoadFormFile(file string) (*List, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -37,11 +38,22 @@ func LoadFormFile(file string) (*List, error) {
 	return LoadFormReader(f)
 }
 
+// maxLineSize is the max length of a line, long regexp rules can be
+// longer than the default 64KiB limit of bufio.Scanner.
+const maxLineSize = 1024 * 1024
+
+// LoadFormReader loads a domain list from r.
+// Each line is a rule. The format is [type:]value, type can be
+// "domain", "full", "keyword" or "regexp". Lines without a type
+// are domain rules. Attributes (e.g. " @cn") after the value are ignored.
 func LoadFormReader(r io.Reader) (*List, error) {
 	l := New()
 
 	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxLineSize)
+	lineCounter := 0
 	for s.Scan() {
+		lineCounter++
 		line := strings.TrimSpace(s.Text())
 
 		//ignore lines begin with # and empty lines
@@ -49,13 +61,62 @@ func LoadFormReader(r io.Reader) (*List, error) {
 			continue
 		}
 
-		fqdn := dns.Fqdn(line)
-		if _, ok := dns.IsDomainName(fqdn); !ok {
-			return nil, fmt.Errorf("invaild domain [%s]", line)
+		if err := l.AddRule(line); err != nil {
+			return nil, fmt.Errorf("invalid rule in line %d: %w", lineCounter, err)
 		}
-		l.Add(fqdn)
-
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
 	}
 
 	return l, nil
 }
+
+// AddRule parses a rule string s in [type:]value format and adds it to l.
+func (l *List) AddRule(s string) error {
+	if i := strings.Index(s, " @"); i != -1 { // remove attributes
+		s = strings.TrimSpace(s[:i])
+	}
+
+	t := MatchDomain
+	v := s
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		switch s[:i] {
+		case "domain":
+			t = MatchDomain
+		case "full":
+			t = MatchFull
+		case "keyword":
+			t = MatchKeyword
+		case "regexp":
+			t = MatchRegexp
+		default:
+			return fmt.Errorf("unknown rule type [%s]", s[:i])
+		}
+		v = s[i+1:]
+	}
+
+	if len(v) == 0 {
+		return fmt.Errorf("empty rule [%s]", s)
+	}
+
+	switch t {
+	case MatchDomain, MatchFull:
+		fqdn := dns.Fqdn(v)
+		if _, ok := dns.IsDomainName(fqdn); !ok {
+			return fmt.Errorf("invaild domain [%s]", v)
+		}
+		if t == MatchDomain {
+			l.Add(fqdn)
+		} else {
+			l.AddFull(fqdn)
+		}
+	case MatchKeyword:
+		l.AddKeyword(v)
+	case MatchRegexp:
+		if err := l.AddRegexp(v); err != nil {
+			return fmt.Errorf("invalid regexp [%s]: %w", v, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package iptrie implements a path-compressed binary (Patricia) trie
+// for ip prefixes with longest-prefix matching.
+package iptrie
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// key is a 128-bit ip address. IPv4 addresses are stored as IPv4-mapped IPv6 addresses.
+type key struct {
+	hi, lo uint64
+}
+
+func keyFromIP(ip net.IP) (key, bool) {
+	var k key
+	if len(ip) == net.IPv4len { // avoid the allocation in ip.To16()
+		k.lo = 0xffff<<32 | uint64(ip[0])<<24 | uint64(ip[1])<<16 | uint64(ip[2])<<8 | uint64(ip[3])
+		return k, true
+	}
+	if len(ip) != net.IPv6len {
+		return key{}, false
+	}
+	for i := 0; i < 8; i++ {
+		k.hi = k.hi<<8 | uint64(ip[i])
+		k.lo = k.lo<<8 | uint64(ip[i+8])
+	}
+	return k, true
+}
+
+func (k key) toIP() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 8; i++ {
+		ip[7-i] = byte(k.hi >> (8 * uint(i)))
+		ip[15-i] = byte(k.lo >> (8 * uint(i)))
+	}
+	return ip
+}
+
+// bit returns the i-th bit of k, from the most significant bit.
+func (k key) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// mask returns k with only its first n bits.
+func (k key) mask(n uint8) key {
+	switch {
+	case n == 0:
+		return key{}
+	case n < 64:
+		return key{hi: k.hi &^ (^uint64(0) >> n)}
+	case n == 64:
+		return key{hi: k.hi}
+	case n < 128:
+		return key{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	default:
+		return k
+	}
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b, up to max.
+func commonPrefixLen(a, b key, max uint8) uint8 {
+	var n int
+	if x := a.hi ^ b.hi; x != 0 {
+		n = bits.LeadingZeros64(x)
+	} else {
+		n = 64 + bits.LeadingZeros64(a.lo^b.lo)
+	}
+	if n > int(max) {
+		return max
+	}
+	return uint8(n)
+}
+
+type node struct {
+	key      key
+	bits     uint8
+	terminal bool // a prefix was inserted at this node
+	child    [2]*node
+}
+
+// Trie is a set of ip prefixes. It is safe for concurrent use.
+type Trie struct {
+	l    sync.RWMutex
+	root *node
+	size int
+}
+
+// New returns a empty Trie.
+func New() *Trie {
+	return &Trie{}
+}
+
+var errInvalidIP = errors.New("invalid ip")
+
+// toKey converts ip and its prefix length to a masked key.
+// If isV4 is true, ones is an ipv4 prefix length.
+func toKey(ip net.IP, ones int, isV4 bool) (key, uint8, error) {
+	k, ok := keyFromIP(ip)
+	if !ok {
+		return key{}, 0, errInvalidIP
+	}
+	if isV4 {
+		if ones < 0 || ones > 32 {
+			return key{}, 0, fmt.Errorf("invalid ipv4 prefix length %d", ones)
+		}
+		ones += 96
+	}
+	if ones < 0 || ones > 128 {
+		return key{}, 0, fmt.Errorf("invalid ipv6 prefix length %d", ones)
+	}
+	return k.mask(uint8(ones)), uint8(ones), nil
+}
+
+func ipNetToKey(n *net.IPNet) (key, uint8, error) {
+	ones, size := n.Mask.Size()
+	if size == 0 {
+		return key{}, 0, errors.New("non-canonical mask")
+	}
+	return toKey(n.IP, ones, size == 32)
+}
+
+// Insert inserts n to t. It returns false if n is already in t.
+func (t *Trie) Insert(n *net.IPNet) (bool, error) {
+	k, b, err := ipNetToKey(n)
+	if err != nil {
+		return false, err
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.insert(k, b), nil
+}
+
+// InsertPrefix inserts ip/ones to t. ones is the ipv4 prefix length if ip is an ipv4 address.
+func (t *Trie) InsertPrefix(ip net.IP, ones int) (bool, error) {
+	k, b, err := toKey(ip, ones, ip.To4() != nil)
+	if err != nil {
+		return false, err
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.insert(k, b), nil
+}
+
+func (t *Trie) insert(k key, b uint8) bool {
+	p := &t.root
+	for {
+		n := *p
+		if n == nil {
+			*p = &node{key: k, bits: b, terminal: true}
+			t.size++
+			return true
+		}
+
+		minBits := n.bits
+		if b < minBits {
+			minBits = b
+		}
+		common := commonPrefixLen(n.key, k, minBits)
+
+		switch {
+		case common == n.bits && common == b: // same prefix
+			if n.terminal {
+				return false
+			}
+			n.terminal = true
+			t.size++
+			return true
+		case common == n.bits: // n covers k, go deeper
+			p = &n.child[k.bit(n.bits)]
+			continue
+		case common == b: // k covers n
+			nn := &node{key: k, bits: b, terminal: true}
+			nn.child[n.key.bit(b)] = n
+			*p = nn
+		default: // split at common
+			mid := &node{key: k.mask(common), bits: common}
+			mid.child[k.bit(common)] = &node{key: k, bits: b, terminal: true}
+			mid.child[n.key.bit(common)] = n
+			*p = mid
+		}
+		t.size++
+		return true
+	}
+}
+
+// Delete removes n from t. It returns false if n is not in t.
+// Only the exact prefix is removed, prefixes inside n are not affected.
+func (t *Trie) Delete(n *net.IPNet) (bool, error) {
+	k, b, err := ipNetToKey(n)
+	if err != nil {
+		return false, err
+	}
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	var parent **node
+	p := &t.root
+	for n := *p; n != nil; n = *p {
+		if n.bits > b || commonPrefixLen(n.key, k, n.bits) < n.bits {
+			return false, nil
+		}
+		if n.bits == b {
+			if !n.terminal {
+				return false, nil
+			}
+			n.terminal = false
+			t.size--
+			compact(p)
+			if parent != nil {
+				compact(parent)
+			}
+			return true, nil
+		}
+		parent = p
+		p = &n.child[k.bit(n.bits)]
+	}
+	return false, nil
+}
+
+// compact removes the non-terminal node at p if it has less than two children.
+func compact(p **node) {
+	n := *p
+	if n == nil || n.terminal {
+		return
+	}
+	switch {
+	case n.child[0] == nil:
+		*p = n.child[1]
+	case n.child[1] == nil:
+		*p = n.child[0]
+	}
+}
+
+// Match returns the longest prefix in t that contains ip.
+func (t *Trie) Match(ip net.IP) (*net.IPNet, bool) {
+	k, ok := keyFromIP(ip)
+	if !ok {
+		return nil, false
+	}
+
+	t.l.RLock()
+	best := t.match(k)
+	t.l.RUnlock()
+
+	if best == nil {
+		return nil, false
+	}
+	return best.ipNet(), true
+}
+
+// Contains reports whether ip is in any prefix of t.
+func (t *Trie) Contains(ip net.IP) bool {
+	k, ok := keyFromIP(ip)
+	if !ok {
+		return false
+	}
+
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.match(k) != nil
+}
+
+func (t *Trie) match(k key) (best *node) {
+	for n := t.root; n != nil; {
+		// Only terminal nodes need to be verified. If a non-terminal node
+		// doesn't match k, none of its descendants will match k either.
+		if n.terminal {
+			if commonPrefixLen(n.key, k, n.bits) < n.bits {
+				break
+			}
+			best = n
+		}
+		if n.bits == 128 {
+			break
+		}
+		n = n.child[k.bit(n.bits)]
+	}
+	return best
+}
+
+var v4InV6Prefix = key{lo: 0xffff << 32}
+
+func (n *node) ipNet() *net.IPNet {
+	ip := n.key.toIP()
+	if n.bits >= 96 && n.key.mask(96) == v4InV6Prefix {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(int(n.bits)-96, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(n.bits), 128)}
+}
+
+// Len returns the number of prefixes in t.
+func (t *Trie) Len() int {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.size
+}
+
+// Walk calls f for every prefix in t in ascending order.
+// If f returns false, Walk stops. t must not be modified in f.
+func (t *Trie) Walk(f func(n *net.IPNet) bool) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	walk(t.root, f)
+}
+
+func walk(n *node, f func(n *net.IPNet) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.terminal && !f(n.ipNet()) {
+		return false
+	}
+	return walk(n.child[0], f) && walk(n.child[1], f)
+}
+
+// ParsePrefix parses a CIDR notation or a single ip (as a /32 or /128 prefix).
+func ParsePrefix(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') != -1 {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errInvalidIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// LoadFromFile loads prefixes from a text file.
+func LoadFromFile(file string) (*Trie, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadFromReader(f)
+}
+
+// LoadFromReader loads prefixes from r. Each line is a CIDR or a single ip.
+// Empty lines and lines begin with # are ignored.
+func LoadFromReader(r io.Reader) (*Trie, error) {
+	t := New()
+	s := bufio.NewScanner(r)
+	lineCounter := 0
+	for s.Scan() {
+		lineCounter++
+		line := strings.TrimSpace(s.Text())
+
+		//ignore lines begin with # and empty lines
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ipNet, err := ParsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("invaild CIDR format in line %d: %w", lineCounter, err)
+		}
+		if _, err := t.Insert(ipNet); err != nil {
+			return nil, fmt.Errorf("invaild CIDR in line %d: %w", lineCounter, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
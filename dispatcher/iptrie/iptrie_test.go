@@ -0,0 +1,225 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package iptrie
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+
+	netlist "github.com/IrineSistiana/net-list"
+)
+
+func mustParsePrefix(s string) *net.IPNet {
+	n, err := ParsePrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func Test_Trie(t *testing.T) {
+	list := `
+# comment
+1.0.0.0/8
+1.2.0.0/16
+1.2.3.4
+2001:db8::/32
+2001:db8:1::/48
+`
+	tr, err := LoadFromReader(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Len() != 5 {
+		t.Fatalf("want 5 prefixes, got %d", tr.Len())
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.1.1.1", "1.0.0.0/8"},
+		{"1.2.1.1", "1.2.0.0/16"},
+		{"1.2.3.4", "1.2.3.4/32"},
+		{"1.2.3.5", "1.2.0.0/16"},
+		{"2.0.0.1", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::/48"},
+		{"2001:db9::1", ""},
+		{"::1", ""},
+	}
+	check := func() {
+		for _, tt := range tests {
+			n, ok := tr.Match(net.ParseIP(tt.ip))
+			if ok != (len(tt.want) != 0) || ok != tr.Contains(net.ParseIP(tt.ip)) {
+				t.Fatalf("%s: want %s, got %v", tt.ip, tt.want, n)
+			}
+			if ok && n.String() != tt.want {
+				t.Fatalf("%s: want %s, got %s", tt.ip, tt.want, n)
+			}
+		}
+	}
+	check()
+
+	// insert again
+	if ok, _ := tr.Insert(mustParsePrefix("1.2.0.0/16")); ok {
+		t.Fatal("duplicated prefix was inserted")
+	}
+
+	// delete
+	if ok, _ := tr.Delete(mustParsePrefix("1.2.0.0/16")); !ok {
+		t.Fatal("failed to delete")
+	}
+	if ok, _ := tr.Delete(mustParsePrefix("1.2.0.0/16")); ok {
+		t.Fatal("deleted a missing prefix")
+	}
+	if ok, _ := tr.Delete(mustParsePrefix("1.3.0.0/16")); ok {
+		t.Fatal("deleted a missing prefix")
+	}
+	tests[1].want = "1.0.0.0/8"
+	tests[3].want = "1.0.0.0/8"
+	check()
+
+	if ok, _ := tr.InsertPrefix(net.ParseIP("2.0.0.0"), 8); !ok {
+		t.Fatal("failed to insert")
+	}
+	tests[4].want = "2.0.0.0/8"
+	check()
+
+	var walked []string
+	tr.Walk(func(n *net.IPNet) bool {
+		walked = append(walked, n.String())
+		return true
+	})
+	if strings.Join(walked, ",") != "1.0.0.0/8,1.2.3.4/32,2.0.0.0/8,2001:db8::/32,2001:db8:1::/48" {
+		t.Fatalf("unexpected walk result %v", walked)
+	}
+}
+
+func randPrefix(r *rand.Rand, minOnes, maxOnes int) *net.IPNet {
+	ip := make(net.IP, 4)
+	r.Read(ip)
+	ones := minOnes + r.Intn(maxOnes-minOnes+1)
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}
+}
+
+// compare the trie with a brute-force search
+func Test_Trie_random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := New()
+	var nets []*net.IPNet
+	for i := 0; i < 2000; i++ {
+		n := randPrefix(r, 8, 32)
+		if ok, _ := tr.Insert(n); ok {
+			nets = append(nets, n)
+		}
+	}
+	// delete a half
+	for i := 0; i < len(nets)/2; i++ {
+		if ok, _ := tr.Delete(nets[i]); !ok {
+			t.Fatalf("failed to delete %s", nets[i])
+		}
+	}
+	nets = nets[len(nets)/2:]
+	if tr.Len() != len(nets) {
+		t.Fatalf("want len %d, got %d", len(nets), tr.Len())
+	}
+
+	for i := 0; i < 20000; i++ {
+		ip := make(net.IP, 4)
+		r.Read(ip)
+		var want *net.IPNet
+		for _, n := range nets {
+			if n.Contains(ip) {
+				if ones, _ := n.Mask.Size(); want == nil || ones > func() int { o, _ := want.Mask.Size(); return o }() {
+					want = n
+				}
+			}
+		}
+		got, ok := tr.Match(ip)
+		if ok != (want != nil) {
+			t.Fatalf("%s: want %v, got %v", ip, want, got)
+		}
+		if ok && got.String() != want.String() {
+			t.Fatalf("%s: want %s, got %s", ip, want, got)
+		}
+	}
+}
+
+func benchmarkData(n int) (*Trie, *netlist.List, []net.IP) {
+	r := rand.New(rand.NewSource(1))
+	buf := new(bytes.Buffer)
+	for i := 0; i < n; i++ {
+		buf.WriteString(randPrefix(r, 16, 24).String())
+		buf.WriteByte('\n')
+	}
+	tr, err := LoadFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+	nl, err := netlist.NewListFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		panic(err)
+	}
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = make(net.IP, 4)
+		r.Read(ips[i])
+	}
+	return tr, nl, ips
+}
+
+func Benchmark_Trie_Contains(b *testing.B) {
+	tr, _, ips := benchmarkData(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Contains(ips[i&1023])
+	}
+}
+
+func Benchmark_NetList_Contains(b *testing.B) {
+	_, nl, ips := benchmarkData(200000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ipv6, _ := netlist.Conv(ips[i&1023])
+		nl.Contains(ipv6)
+	}
+}
+
+func Benchmark_Trie_InsertDelete(b *testing.B) {
+	tr, _, _ := benchmarkData(200000)
+	n := mustParsePrefix("203.0.113.0/24")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Insert(n)
+		tr.Delete(n)
+	}
+}
+
+func Benchmark_NetList_AppendSort(b *testing.B) {
+	_, nl, _ := benchmarkData(200000)
+	n, _ := netlist.ParseCIDR("203.0.113.0/24")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nl.Append(n)
+		nl.Sort()
+	}
+}
@@ -0,0 +1,352 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package listbin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+	"github.com/miekg/dns"
+)
+
+// domain list payload:
+//	domainSlots  uint32
+//	fullSlots    uint32
+//	keywordCount uint32
+//	regexpCount  uint32
+//	domainTable  [domainSlots]uint32
+//	fullTable    [fullSlots]uint32
+//	keywords     [keywordCount]uint32
+//	regexps      [regexpCount]uint32
+//	strings      string pool, each string is a uint16 length and the data.
+// domainTable and fullTable are open addressing hash tables with linear
+// probing. Slot sizes are powers of two. Each slot or entry is the
+// offset of the string data in the pool, which is never 0, 0 means a empty slot.
+
+const domainHeaderSize = 16
+
+// hashString is the 32-bit FNV-1a hash of s.
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func tableSize(n int) int {
+	size := 1
+	for size < n*2 {
+		size <<= 1
+	}
+	return size
+}
+
+// CompileDomainList compiles l and writes it to w.
+func CompileDomainList(l *domainlist.List, w io.Writer) error {
+	var domains, fulls, keywords, regexps []string
+	l.Walk(func(r domainlist.Rule) {
+		switch r.Type {
+		case domainlist.MatchDomain:
+			domains = append(domains, r.Value)
+		case domainlist.MatchFull:
+			fulls = append(fulls, r.Value)
+		case domainlist.MatchKeyword:
+			keywords = append(keywords, r.Value)
+		case domainlist.MatchRegexp:
+			regexps = append(regexps, r.Value)
+		}
+	})
+
+	var pool []byte
+	addString := func(s string) (uint32, error) {
+		if len(s) > math.MaxUint16 {
+			return 0, fmt.Errorf("rule [%.32s...] is too long", s)
+		}
+		off := uint32(len(pool)) + 2
+		pool = append(pool, byte(len(s)), byte(len(s)>>8))
+		pool = append(pool, s...)
+		return off, nil
+	}
+	buildTable := func(ss []string) ([]uint32, error) {
+		table := make([]uint32, tableSize(len(ss)))
+		mask := uint32(len(table) - 1)
+		for _, s := range ss {
+			off, err := addString(s)
+			if err != nil {
+				return nil, err
+			}
+			i := hashString(s) & mask
+			for table[i] != 0 {
+				i = (i + 1) & mask
+			}
+			table[i] = off
+		}
+		return table, nil
+	}
+	buildArray := func(ss []string) ([]uint32, error) {
+		a := make([]uint32, 0, len(ss))
+		for _, s := range ss {
+			off, err := addString(s)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, off)
+		}
+		return a, nil
+	}
+
+	domainTable, err := buildTable(domains)
+	if err != nil {
+		return err
+	}
+	fullTable, err := buildTable(fulls)
+	if err != nil {
+		return err
+	}
+	keywordArray, err := buildArray(keywords)
+	if err != nil {
+		return err
+	}
+	regexpArray, err := buildArray(regexps)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, domainHeaderSize)
+	binary.LittleEndian.PutUint32(payload[0:], uint32(len(domainTable)))
+	binary.LittleEndian.PutUint32(payload[4:], uint32(len(fullTable)))
+	binary.LittleEndian.PutUint32(payload[8:], uint32(len(keywordArray)))
+	binary.LittleEndian.PutUint32(payload[12:], uint32(len(regexpArray)))
+	for _, a := range [][]uint32{domainTable, fullTable, keywordArray, regexpArray} {
+		for _, u := range a {
+			payload = append(payload, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
+		}
+	}
+	payload = append(payload, pool...)
+	return writeFile(w, KindDomain, payload)
+}
+
+// DomainList is a compiled domain list.
+// It has the same match behavior as domainlist.List.
+type DomainList struct {
+	domainTable []byte
+	fullTable   []byte
+	pool        []byte
+	keywords    []string
+	regexps     []*regexp.Regexp
+	length      int
+	release     func() error
+}
+
+// OpenDomainList opens a compiled domain list file. The file is memory-mapped,
+// DomainList must be closed after use.
+func OpenDomainList(file string) (*DomainList, error) {
+	payload, release, err := openFile(file, KindDomain)
+	if err != nil {
+		return nil, err
+	}
+	l, err := newDomainList(payload)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	l.release = release
+	return l, nil
+}
+
+// DecodeDomainList decodes a compiled domain list from b.
+func DecodeDomainList(b []byte) (*DomainList, error) {
+	kind, payload, err := decodeFile(b)
+	if err != nil {
+		return nil, err
+	}
+	if kind != KindDomain {
+		return nil, fmt.Errorf("data is a compiled %s list", kind)
+	}
+	return newDomainList(payload)
+}
+
+func newDomainList(payload []byte) (*DomainList, error) {
+	if len(payload) < domainHeaderSize {
+		return nil, fmt.Errorf("%w: short payload", ErrBrokenData)
+	}
+	domainSlots := uint64(binary.LittleEndian.Uint32(payload[0:]))
+	fullSlots := uint64(binary.LittleEndian.Uint32(payload[4:]))
+	keywordCount := uint64(binary.LittleEndian.Uint32(payload[8:]))
+	regexpCount := uint64(binary.LittleEndian.Uint32(payload[12:]))
+	if domainSlots&(domainSlots-1) != 0 || fullSlots&(fullSlots-1) != 0 {
+		return nil, fmt.Errorf("%w: invalid table size", ErrBrokenData)
+	}
+	tablesEnd := domainHeaderSize + (domainSlots+fullSlots+keywordCount+regexpCount)*4
+	if tablesEnd > uint64(len(payload)) {
+		return nil, fmt.Errorf("%w: short payload", ErrBrokenData)
+	}
+
+	l := new(DomainList)
+	off := uint64(domainHeaderSize)
+	l.domainTable = payload[off : off+domainSlots*4]
+	off += domainSlots * 4
+	l.fullTable = payload[off : off+fullSlots*4]
+	off += fullSlots * 4
+	l.pool = payload[tablesEnd:]
+
+	// verify all entries, so we don't have to check bounds in lookups.
+	var err error
+	for _, table := range [][]byte{l.domainTable, l.fullTable} {
+		for i := 0; i < len(table); i += 4 {
+			if o := binary.LittleEndian.Uint32(table[i:]); o != 0 {
+				if _, err = l.stringAt(o); err != nil {
+					return nil, err
+				}
+				l.length++
+			}
+		}
+	}
+
+	for i := uint64(0); i < keywordCount+regexpCount; i++ {
+		s, err := l.stringAt(binary.LittleEndian.Uint32(payload[off+i*4:]))
+		if err != nil {
+			return nil, err
+		}
+		if i < keywordCount {
+			l.keywords = append(l.keywords, s)
+		} else {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regexp [%s]: %w", s, err)
+			}
+			l.regexps = append(l.regexps, re)
+		}
+		l.length++
+	}
+	return l, nil
+}
+
+// stringAt returns the string whose data starts at the pool offset o.
+func (l *DomainList) stringAt(o uint32) (string, error) {
+	if o < 2 || uint64(o) > uint64(len(l.pool)) {
+		return "", fmt.Errorf("%w: invalid string offset", ErrBrokenData)
+	}
+	start := int(o)
+	n := int(binary.LittleEndian.Uint16(l.pool[start-2:]))
+	if start+n > len(l.pool) {
+		return "", fmt.Errorf("%w: invalid string length", ErrBrokenData)
+	}
+	return string(l.pool[start : start+n]), nil
+}
+
+func (l *DomainList) poolEqual(o uint32, s string) bool {
+	start := int(o)
+	n := int(binary.LittleEndian.Uint16(l.pool[start-2:]))
+	return n == len(s) && string(l.pool[start:start+n]) == s
+}
+
+func (l *DomainList) tableHas(table []byte, s string) bool {
+	slots := uint32(len(table) / 4)
+	if slots == 0 {
+		return false
+	}
+	mask := slots - 1
+	i := hashString(s) & mask
+	for n := uint32(0); n < slots; n++ {
+		o := binary.LittleEndian.Uint32(table[i*4:])
+		if o == 0 {
+			return false
+		}
+		if l.poolEqual(o, s) {
+			return true
+		}
+		i = (i + 1) & mask
+	}
+	return false
+}
+
+// Has reports whether fqdn is matched by any rule in the list.
+func (l *DomainList) Has(fqdn string) bool {
+	_, ok := l.Match(fqdn)
+	return ok
+}
+
+// Match returns the first rule that matches fqdn.
+// Rules are checked in this order: full, domain, keyword, regexp.
+func (l *DomainList) Match(fqdn string) (domainlist.Rule, bool) {
+	if fqdn == "." {
+		return domainlist.Rule{}, false
+	}
+
+	if l.tableHas(l.fullTable, fqdn) {
+		return domainlist.Rule{Type: domainlist.MatchFull, Value: fqdn}, true
+	}
+
+	if len(l.domainTable) != 0 {
+		idx := make([]int, 1, 6)
+		off := 0
+		end := false
+		for {
+			off, end = dns.NextLabel(fqdn, off)
+			if end {
+				break
+			}
+			idx = append(idx, off)
+		}
+
+		for i := range idx {
+			p := idx[len(idx)-1-i]
+			if l.tableHas(l.domainTable, fqdn[p:]) {
+				return domainlist.Rule{Type: domainlist.MatchDomain, Value: fqdn[p:]}, true
+			}
+		}
+	}
+
+	if len(l.keywords) == 0 && len(l.regexps) == 0 {
+		return domainlist.Rule{}, false
+	}
+
+	domain := strings.TrimSuffix(fqdn, ".")
+	for _, k := range l.keywords {
+		if strings.Contains(domain, k) {
+			return domainlist.Rule{Type: domainlist.MatchKeyword, Value: k}, true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(domain) {
+			return domainlist.Rule{Type: domainlist.MatchRegexp, Value: re.String()}, true
+		}
+	}
+	return domainlist.Rule{}, false
+}
+
+// Len returns the number of rules in the list.
+func (l *DomainList) Len() int {
+	return l.length
+}
+
+// Close releases the memory-mapped file.
+func (l *DomainList) Close() error {
+	if l.release != nil {
+		return l.release()
+	}
+	return nil
+}
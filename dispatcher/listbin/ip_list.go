@@ -0,0 +1,152 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package listbin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+)
+
+// ip list payload:
+//	count  uint64
+//	ranges [count]struct{ start, end [16]byte }
+// ranges are sorted and not overlapped. ipv4 addresses are
+// stored as ipv4-mapped ipv6 addresses.
+
+const ipRangeSize = 32
+
+// CompileIPList compiles the prefixes in t and writes them to w.
+func CompileIPList(t *iptrie.Trie, w io.Writer) error {
+	var ranges [][2]net.IP
+	t.Walk(func(n *net.IPNet) bool {
+		start := n.IP.To16()
+		end := make(net.IP, net.IPv6len)
+		mask := n.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		ranges = append(ranges, [2]net.IP{start, end})
+		return true
+	})
+
+	// Walk returns prefixes in ascending order, merge overlapped ranges.
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if last := len(merged) - 1; last >= 0 && bytes.Compare(r[0], merged[last][1]) <= 0 {
+			if bytes.Compare(r[1], merged[last][1]) > 0 {
+				merged[last][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	payload := make([]byte, 8, 8+len(merged)*ipRangeSize)
+	binary.LittleEndian.PutUint64(payload, uint64(len(merged)))
+	for _, r := range merged {
+		payload = append(payload, r[0]...)
+		payload = append(payload, r[1]...)
+	}
+	return writeFile(w, KindIP, payload)
+}
+
+// IPList is a compiled ip list.
+type IPList struct {
+	ranges  []byte
+	count   int
+	release func() error
+}
+
+// OpenIPList opens a compiled ip list file. The file is memory-mapped,
+// IPList must be closed after use.
+func OpenIPList(file string) (*IPList, error) {
+	payload, release, err := openFile(file, KindIP)
+	if err != nil {
+		return nil, err
+	}
+	l, err := newIPList(payload)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	l.release = release
+	return l, nil
+}
+
+// DecodeIPList decodes a compiled ip list from b.
+func DecodeIPList(b []byte) (*IPList, error) {
+	kind, payload, err := decodeFile(b)
+	if err != nil {
+		return nil, err
+	}
+	if kind != KindIP {
+		return nil, fmt.Errorf("data is a compiled %s list", kind)
+	}
+	return newIPList(payload)
+}
+
+func newIPList(payload []byte) (*IPList, error) {
+	if len(payload) < 8 {
+		return nil, fmt.Errorf("%w: short payload", ErrBrokenData)
+	}
+	count := binary.LittleEndian.Uint64(payload)
+	if uint64(len(payload)-8) != count*ipRangeSize {
+		return nil, fmt.Errorf("%w: payload length mismatched", ErrBrokenData)
+	}
+	return &IPList{ranges: payload[8:], count: int(count)}, nil
+}
+
+// Contains reports whether ip is in the list.
+func (l *IPList) Contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// find the first range whose end >= ip
+	i := sort.Search(l.count, func(i int) bool {
+		off := i*ipRangeSize + net.IPv6len
+		return bytes.Compare(l.ranges[off:off+net.IPv6len], ip) >= 0
+	})
+	if i == l.count {
+		return false
+	}
+	off := i * ipRangeSize
+	return bytes.Compare(l.ranges[off:off+net.IPv6len], ip) <= 0
+}
+
+// Len returns the number of ranges in the list.
+func (l *IPList) Len() int {
+	return l.count
+}
+
+// Close releases the memory-mapped file.
+func (l *IPList) Close() error {
+	if l.release != nil {
+		return l.release()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package listbin compiles text domain and ip lists into a compact binary
+// format that can be memory-mapped and queried without parsing.
+//
+// A compiled list file has a 32 bytes header:
+//
+//	magic      [8]byte "MOSLIST\x00"
+//	version    uint16
+//	kind       uint16
+//	reserved   uint32
+//	payloadLen uint64
+//	checksum   uint32 CRC-32C of the payload
+//	reserved   uint32
+//
+// followed by the payload. All integers are little endian.
+package listbin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/mmap"
+)
+
+// Kind is the kind of a compiled list.
+type Kind uint16
+
+const (
+	// KindDomain is a compiled domain list.
+	KindDomain Kind = 1
+	// KindIP is a compiled ip list.
+	KindIP Kind = 2
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindDomain:
+		return "domain"
+	case KindIP:
+		return "ip"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint16(k))
+	}
+}
+
+const (
+	// Version is the current format version.
+	Version    = 2
+	headerSize = 32
+)
+
+var (
+	magic = []byte("MOSLIST\x00")
+
+	// ErrNotCompiled indicates the data is not a compiled list.
+	ErrNotCompiled = errors.New("not a compiled list")
+	// ErrBrokenData indicates the compiled list is broken.
+	ErrBrokenData = errors.New("compiled list is broken")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// writeFile writes the header and payload to w.
+func writeFile(w io.Writer, kind Kind, payload []byte) error {
+	h := make([]byte, headerSize)
+	copy(h, magic)
+	binary.LittleEndian.PutUint16(h[8:], Version)
+	binary.LittleEndian.PutUint16(h[10:], uint16(kind))
+	binary.LittleEndian.PutUint64(h[16:], uint64(len(payload)))
+	binary.LittleEndian.PutUint32(h[24:], crc32.Checksum(payload, crcTable))
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// decodeFile checks the header and checksum of b and returns its payload.
+func decodeFile(b []byte) (Kind, []byte, error) {
+	if !IsCompiled(b) {
+		return 0, nil, ErrNotCompiled
+	}
+	if len(b) < headerSize {
+		return 0, nil, fmt.Errorf("%w: short header", ErrBrokenData)
+	}
+	if v := binary.LittleEndian.Uint16(b[8:]); v != Version {
+		return 0, nil, fmt.Errorf("unsupported version %d, want %d", v, Version)
+	}
+	kind := Kind(binary.LittleEndian.Uint16(b[10:]))
+	payloadLen := binary.LittleEndian.Uint64(b[16:])
+	if payloadLen != uint64(len(b)-headerSize) {
+		return 0, nil, fmt.Errorf("%w: payload length mismatched", ErrBrokenData)
+	}
+	payload := b[headerSize:]
+	if binary.LittleEndian.Uint32(b[24:]) != crc32.Checksum(payload, crcTable) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatched", ErrBrokenData)
+	}
+	return kind, payload, nil
+}
+
+// IsCompiled reports whether b begins with the magic of a compiled list.
+func IsCompiled(b []byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
+
+// IsCompiledFile reports whether file is a compiled list.
+func IsCompiledFile(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	b := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return IsCompiled(b), nil
+}
+
+// openFile maps file into memory and checks its kind.
+// The returned payload is valid until release is called.
+func openFile(file string, want Kind) (payload []byte, release func() error, err error) {
+	b, release, err := mmap.MapFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	kind, payload, err := decodeFile(b)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	if kind != want {
+		release()
+		return nil, nil, fmt.Errorf("%s is a compiled %s list, not a %s list", file, kind, want)
+	}
+	return payload, release, nil
+}
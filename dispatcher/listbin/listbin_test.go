@@ -0,0 +1,156 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package listbin
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+)
+
+func Test_DomainList(t *testing.T) {
+	text := `
+cn
+a.com
+full:b.com
+keyword:google
+regexp:^[a-z]+\.example\.org$
+` + "regexp:^(" + strings.Repeat("x", 300) + "|long)\\.example\\.com$\n"
+	src, err := domainlist.LoadFormReader(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := CompileDomainList(src, buf); err != nil {
+		t.Fatal(err)
+	}
+	l, err := DecodeDomainList(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != src.Len() {
+		t.Fatalf("want len %d, got %d", src.Len(), l.Len())
+	}
+
+	for _, fqdn := range []string{"a.cn.", "cn.", "a.com.", "x.a.com.", "b.com.", "x.b.com.", "google.com.",
+		"www.example.org.", "a.www.example.org.", "example.net.", "long.example.com.", "."} {
+		want, wantOk := src.Match(fqdn)
+		got, ok := l.Match(fqdn)
+		if ok != wantOk || got != want {
+			t.Fatalf("%s: want %v %v, got %v %v", fqdn, want, wantOk, got, ok)
+		}
+	}
+
+	if _, err := DecodeIPList(buf.Bytes()); err == nil {
+		t.Fatal("a domain list was decoded as a ip list")
+	}
+
+	b := buf.Bytes()
+	b[len(b)-1]++
+	if _, err := DecodeDomainList(b); !errors.Is(err, ErrBrokenData) {
+		t.Fatalf("want ErrBrokenData, got %v", err)
+	}
+	if _, err := DecodeDomainList([]byte(text)); !errors.Is(err, ErrNotCompiled) {
+		t.Fatalf("want ErrNotCompiled, got %v", err)
+	}
+}
+
+func Test_DomainList_longRule(t *testing.T) {
+	// the longest rule that fits in the length prefix.
+	src := domainlist.New()
+	src.AddKeyword(strings.Repeat("x", math.MaxUint16))
+	buf := new(bytes.Buffer)
+	if err := CompileDomainList(src, buf); err != nil {
+		t.Fatal(err)
+	}
+	l, err := DecodeDomainList(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Match(strings.Repeat("x", math.MaxUint16) + ".com."); !ok {
+		t.Fatal("the long keyword should be matched")
+	}
+
+	src.AddKeyword(strings.Repeat("y", math.MaxUint16+1))
+	err = CompileDomainList(src, new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "is too long") {
+		t.Fatalf("want a too long error, got %v", err)
+	}
+}
+
+func Test_IPList(t *testing.T) {
+	text := `
+1.0.0.0/24
+1.0.0.128/25
+1.0.1.0/24
+10.0.0.0/8
+2001:db8::/32
+`
+	src, err := iptrie.LoadFromReader(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "listbin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ip.bin")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileIPList(src, f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if ok, err := IsCompiledFile(file); !ok || err != nil {
+		t.Fatalf("IsCompiledFile: %v %v", ok, err)
+	}
+	if _, err := OpenDomainList(file); err == nil {
+		t.Fatal("a ip list was opened as a domain list")
+	}
+
+	l, err := OpenIPList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Len() != 4 { // 1.0.0.128/25 is merged into 1.0.0.0/24
+		t.Fatalf("want 4 ranges, got %d", l.Len())
+	}
+
+	for _, s := range []string{"1.0.0.0", "1.0.0.200", "1.0.1.255", "10.255.255.255", "2001:db8::1",
+		"0.0.0.0", "1.0.2.0", "9.255.255.255", "11.0.0.0", "2001:db9::", "::"} {
+		ip := net.ParseIP(s)
+		if want, got := src.Contains(ip), l.Contains(ip); want != got {
+			t.Fatalf("%s: want %v, got %v", s, want, got)
+		}
+	}
+}
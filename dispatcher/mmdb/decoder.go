@@ -0,0 +1,326 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/big"
+)
+
+// data types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// max depth of nested maps and arrays
+const maxDepth = 32
+
+var (
+	errBrokenData = errors.New("broken data")
+	errTooDeep    = errors.New("data is nested too deep")
+)
+
+// decoder decodes the mmdb data section format.
+// Maps are decoded as map[string]interface{}, arrays as []interface{},
+// all unsigned ints (except uint128, which is *big.Int) as uint64.
+type decoder struct {
+	b []byte
+}
+
+func (d decoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.b)) || off+n < off {
+		return nil, errBrokenData
+	}
+	return d.b[off : off+n], nil
+}
+
+func (d decoder) uint(off, n uint) (uint64, error) {
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// decodeCtrl decodes the control byte(s) at off.
+// For pointers, size is the pointer itself.
+func (d decoder) decodeCtrl(off uint) (typ int, size uint, next uint, err error) {
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	off++
+	typ = int(ctrl >> 5)
+
+	if typ == typePointer {
+		ss := uint(ctrl>>3) & 3
+		vvv := uint64(ctrl & 7)
+		p, err := d.uint(off, ss+1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		switch ss {
+		case 0:
+			p = vvv<<8 | p
+		case 1:
+			p = (vvv<<16 | p) + 2048
+		case 2:
+			p = (vvv<<24 | p) + 526336
+		}
+		return typ, uint(p), off + ss + 1, nil
+	}
+
+	if typ == typeExtended {
+		b, err := d.bytes(off, 1)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		typ = int(b[0]) + 7
+		off++
+	}
+
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		s, err := d.uint(off, n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + uint(s)
+		case 2:
+			size = 285 + uint(s)
+		default:
+			size = 65821 + uint(s)
+		}
+	}
+	return typ, size, off, nil
+}
+
+// decode decodes the value at off, next is the offset of the next value.
+func (d decoder) decode(off uint) (v interface{}, next uint, err error) {
+	return d.decodeWithDepth(off, 0)
+}
+
+func (d decoder) decodeWithDepth(off uint, depth int) (v interface{}, next uint, err error) {
+	if depth > maxDepth {
+		return nil, 0, errTooDeep
+	}
+
+	typ, size, next, err := d.decodeCtrl(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case typePointer:
+		// a pointer to a pointer is not valid, but we don't have to check it.
+		v, _, err := d.decodeWithDepth(size, depth+1)
+		return v, next, err
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, next, err = d.decodeWithDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errBrokenData
+			}
+			v, next, err = d.decodeWithDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[ks] = v
+		}
+		return m, next, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			v, next, err = d.decodeWithDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, next, nil
+	case typeBool:
+		return size != 0, next, nil
+	case typeContainer, typeEndMarker:
+		return nil, next, nil
+	}
+
+	b, err := d.bytes(next, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	next += size
+
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		c := make([]byte, len(b))
+		copy(c, b)
+		return c, next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errBrokenData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errBrokenData
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errBrokenData
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errBrokenData
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int32(u), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errBrokenData
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	default:
+		return nil, 0, errBrokenData
+	}
+}
+
+// skip returns the offset of the value after the value at off.
+func (d decoder) skip(off uint, depth int) (next uint, err error) {
+	if depth > maxDepth {
+		return 0, errTooDeep
+	}
+
+	typ, size, next, err := d.decodeCtrl(off)
+	if err != nil {
+		return 0, err
+	}
+	switch typ {
+	case typePointer, typeBool, typeContainer, typeEndMarker:
+		return next, nil
+	case typeMap:
+		size = size * 2
+		fallthrough
+	case typeArray:
+		for i := uint(0); i < size; i++ {
+			if next, err = d.skip(next, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		return next, nil
+	default:
+		return next + size, nil
+	}
+}
+
+// resolve follows the pointer at off. If the value at off is not a pointer, off is returned.
+func (d decoder) resolve(off uint) (uint, error) {
+	typ, size, _, err := d.decodeCtrl(off)
+	if err != nil {
+		return 0, err
+	}
+	if typ == typePointer {
+		return size, nil
+	}
+	return off, nil
+}
+
+// decodePath decodes the value at the path of the map at off.
+func (d decoder) decodePath(off uint, path []string) (v interface{}, ok bool, err error) {
+	for _, key := range path {
+		if off, err = d.resolve(off); err != nil {
+			return nil, false, err
+		}
+		typ, size, next, err := d.decodeCtrl(off)
+		if err != nil {
+			return nil, false, err
+		}
+		if typ != typeMap {
+			return nil, false, nil
+		}
+
+		found := false
+		for i := uint(0); i < size; i++ {
+			var k interface{}
+			k, next, err = d.decode(next)
+			if err != nil {
+				return nil, false, err
+			}
+			if ks, _ := k.(string); ks == key {
+				off = next
+				found = true
+				break
+			}
+			if next, err = d.skip(next, 0); err != nil {
+				return nil, false, err
+			}
+		}
+		if !found {
+			return nil, false, nil
+		}
+	}
+
+	v, _, err = d.decode(off)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
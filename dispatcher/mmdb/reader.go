@@ -0,0 +1,243 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package mmdb is a minimal reader for MaxMind DB (.mmdb) files,
+// e.g. GeoLite2-Country, GeoLite2-ASN and DB-IP lite databases.
+// See: https://maxmind.github.io/MaxMind-DB/
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/mmap"
+)
+
+var (
+	metadataStartMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+	// ErrInvalidDatabase indicates the database is broken or it is not a mmdb file.
+	ErrInvalidDatabase = errors.New("invalid mmdb database")
+)
+
+const (
+	// metadata is stored in the last 128KiB of the file
+	metadataMaxSize = 128 * 1024
+
+	dataSectionSeparatorSize = 16
+)
+
+// Metadata is the metadata of a mmdb database.
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader reads a mmdb database. It is safe for concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	buf       []byte
+	tree      []byte
+	data      decoder
+	nodeSize  uint
+	ipv4Start uint
+
+	release func() error
+}
+
+// Open opens a mmdb file. The file will be memory-mapped if the os supports it.
+// Reader must be closed after use.
+func Open(file string) (*Reader, error) {
+	b, release, err := mmap.MapFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := FromBytes(b)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	r.release = release
+	return r, nil
+}
+
+// FromBytes reads a mmdb database from b. b must not be modified while the Reader is in use.
+func FromBytes(b []byte) (*Reader, error) {
+	metaStart := 0
+	if len(b) > metadataMaxSize {
+		metaStart = len(b) - metadataMaxSize
+	}
+	i := bytes.LastIndex(b[metaStart:], metadataStartMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	metaStart = metaStart + i + len(metadataStartMarker)
+
+	r := &Reader{buf: b}
+	if err := r.decodeMetadata(decoder{b: b[metaStart:]}); err != nil {
+		return nil, err
+	}
+
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+		r.nodeSize = r.Metadata.RecordSize / 4
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.Metadata.RecordSize)
+	}
+
+	// check the node count first, so the tree size won't overflow.
+	dataEnd := uint(metaStart - len(metadataStartMarker))
+	if r.Metadata.NodeCount > dataEnd/r.nodeSize {
+		return nil, fmt.Errorf("%w: search tree is larger than the file", ErrInvalidDatabase)
+	}
+	treeSize := r.Metadata.NodeCount * r.nodeSize
+	dataStart := treeSize + dataSectionSeparatorSize
+	if dataStart > dataEnd {
+		return nil, fmt.Errorf("%w: search tree is larger than the file", ErrInvalidDatabase)
+	}
+	r.tree = b[:treeSize]
+	r.data = decoder{b: b[dataStart:dataEnd]}
+
+	// In a ipv6 database, ipv4 addresses are stored in ::/96.
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *Reader) decodeMetadata(d decoder) error {
+	v, _, err := d.decode(0)
+	if err != nil {
+		return fmt.Errorf("%w: broken metadata: %v", ErrInvalidDatabase, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+
+	getUint := func(k string) uint64 {
+		u, _ := m[k].(uint64)
+		return u
+	}
+	r.Metadata.NodeCount = uint(getUint("node_count"))
+	r.Metadata.RecordSize = uint(getUint("record_size"))
+	r.Metadata.IPVersion = uint(getUint("ip_version"))
+	r.Metadata.BuildEpoch = getUint("build_epoch")
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return fmt.Errorf("%w: unknown ip version %d", ErrInvalidDatabase, r.Metadata.IPVersion)
+	}
+	return nil
+}
+
+// Close releases the resources of the Reader.
+// Reader can not be used after Close is called.
+func (r *Reader) Close() error {
+	if r.release != nil {
+		return r.release()
+	}
+	return nil
+}
+
+func (r *Reader) readRecord(node, bit uint) uint {
+	b := r.tree[node*r.nodeSize : (node+1)*r.nodeSize]
+	switch r.Metadata.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default: // 32
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+// lookupOffset returns the offset of ip's record in the data section.
+func (r *Reader) lookupOffset(ip net.IP) (off uint, ok bool, err error) {
+	var node uint
+	bitCount := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bitCount = 32
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else {
+		if ip = ip.To16(); ip == nil {
+			return 0, false, fmt.Errorf("invalid ip %v", ip)
+		}
+		if r.Metadata.IPVersion == 4 {
+			return 0, false, nil
+		}
+	}
+
+	nodeCount := r.Metadata.NodeCount
+	for i := 0; i < bitCount && node < nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i&7))) & 1
+		node = r.readRecord(node, bit)
+	}
+
+	switch {
+	case node == nodeCount: // empty
+		return 0, false, nil
+	case node > nodeCount:
+		off = node - nodeCount - dataSectionSeparatorSize
+		if off >= uint(len(r.data.b)) {
+			return 0, false, fmt.Errorf("%w: record points outside the data section", ErrInvalidDatabase)
+		}
+		return off, true, nil
+	default:
+		return 0, false, fmt.Errorf("%w: search tree is too deep", ErrInvalidDatabase)
+	}
+}
+
+// Lookup returns the record of ip. ok is false if ip is not in the database.
+func (r *Reader) Lookup(ip net.IP) (v interface{}, ok bool, err error) {
+	off, ok, err := r.lookupOffset(ip)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	v, _, err = r.data.decode(off)
+	return v, err == nil, err
+}
+
+// LookupPath returns the value at the path in the record of ip.
+// e.g. LookupPath(ip, "country", "iso_code").
+// ok is false if ip is not in the database or the path does not exist.
+// LookupPath only decodes the values on the path, which is much faster than Lookup.
+func (r *Reader) LookupPath(ip net.IP, path ...string) (v interface{}, ok bool, err error) {
+	off, ok, err := r.lookupOffset(ip)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	return r.data.decodePath(off, path)
+}
@@ -0,0 +1,238 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testWriter writes a ipv6 mmdb database with 24 bits records.
+// It only supports maps, strings, uint32s, uint64s and non-overlapping networks.
+type testWriter struct {
+	nodes [][2]int // >= 0: node index, -1: empty, <= -2: data offset (-2-off)
+	data  bytes.Buffer
+}
+
+func (w *testWriter) encodeCtrl(typ int, size int) {
+	if typ > 7 {
+		w.data.WriteByte(byte(size))
+		w.data.WriteByte(byte(typ - 7))
+		return
+	}
+	w.data.WriteByte(byte(typ<<5 | size))
+}
+
+func (w *testWriter) encode(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		w.encodeCtrl(typeString, len(v))
+		w.data.WriteString(v)
+	case uint32:
+		w.encodeCtrl(typeUint32, 4)
+		binary.Write(&w.data, binary.BigEndian, v)
+	case uint64:
+		w.encodeCtrl(typeUint64, 8)
+		binary.Write(&w.data, binary.BigEndian, v)
+	case map[string]interface{}:
+		w.encodeCtrl(typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.encode(k)
+			w.encode(v[k])
+		}
+	default:
+		panic("unsupported type")
+	}
+}
+
+func (w *testWriter) insert(cidr string, v map[string]interface{}) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := ipNet.Mask.Size()
+	if ip.To4() != nil {
+		ones += 96
+		ip = append(make(net.IP, 12), ip.To4()...)
+	}
+
+	off := w.data.Len()
+	w.encode(v)
+
+	if len(w.nodes) == 0 {
+		w.nodes = append(w.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i>>3]>>(7-uint(i&7))) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -2 - off
+			break
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+func (w *testWriter) bytes() []byte {
+	b := new(bytes.Buffer)
+	nodeCount := len(w.nodes)
+	for _, n := range w.nodes {
+		for _, r := range n {
+			var u int
+			switch {
+			case r >= 0:
+				u = r
+			case r == -1:
+				u = nodeCount
+			default:
+				u = -2 - r + nodeCount + dataSectionSeparatorSize
+			}
+			b.Write([]byte{byte(u >> 16), byte(u >> 8), byte(u)})
+		}
+	}
+	b.Write(make([]byte, dataSectionSeparatorSize))
+	b.Write(w.data.Bytes())
+	b.Write(metadataStartMarker)
+
+	meta := &testWriter{}
+	meta.encode(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(6),
+		"database_type": "test",
+	})
+	b.Write(meta.data.Bytes())
+	return b.Bytes()
+}
+
+func newTestDB() []byte {
+	w := new(testWriter)
+	w.insert("1.0.1.0/24", map[string]interface{}{
+		"country":                  map[string]interface{}{"iso_code": "CN", "geoname_id": uint32(1814991)},
+		"autonomous_system_number": uint32(4134),
+	})
+	w.insert("8.8.8.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+	})
+	w.insert("2001:250::/35", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "CN"},
+	})
+	return w.bytes()
+}
+
+func Test_Reader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(file, newTestDB(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Metadata.DatabaseType != "test" || r.Metadata.IPVersion != 6 || r.Metadata.RecordSize != 24 {
+		t.Fatalf("unexpected metadata %+v", r.Metadata)
+	}
+
+	tests := []struct {
+		ip     string
+		path   []string
+		want   interface{}
+		wantOk bool
+	}{
+		{"1.0.1.1", []string{"country", "iso_code"}, "CN", true},
+		{"1.0.1.1", []string{"autonomous_system_number"}, uint64(4134), true},
+		{"1.0.1.1", []string{"country", "geoname_id"}, uint64(1814991), true},
+		{"8.8.8.8", []string{"country", "iso_code"}, "US", true},
+		{"8.8.8.8", []string{"autonomous_system_number"}, nil, false},
+		{"2001:250::1", []string{"country", "iso_code"}, "CN", true},
+		{"1.0.2.1", []string{"country", "iso_code"}, nil, false},
+		{"2001:251::1", []string{"country", "iso_code"}, nil, false},
+	}
+	for _, tt := range tests {
+		v, ok, err := r.LookupPath(net.ParseIP(tt.ip), tt.path...)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.ip, err)
+		}
+		if ok != tt.wantOk || v != tt.want {
+			t.Fatalf("%s %v: want %v %v, got %v %v", tt.ip, tt.path, tt.want, tt.wantOk, v, ok)
+		}
+	}
+
+	v, ok, err := r.Lookup(net.ParseIP("1.0.1.1"))
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	m := v.(map[string]interface{})
+	if m["country"].(map[string]interface{})["iso_code"] != "CN" {
+		t.Fatalf("unexpected record %v", m)
+	}
+}
+
+// newTestDBWithoutData returns a database that has a tree of size prefix and
+// claims nodeCount nodes.
+func newTestDBWithoutData(prefix int, nodeCount uint64) []byte {
+	b := bytes.NewBuffer(make([]byte, prefix))
+	b.Write(metadataStartMarker)
+	meta := &testWriter{}
+	meta.encode(map[string]interface{}{
+		"node_count":  nodeCount,
+		"record_size": uint32(24),
+		"ip_version":  uint32(6),
+	})
+	b.Write(meta.data.Bytes())
+	return b.Bytes()
+}
+
+func Test_FromBytes_invalid(t *testing.T) {
+	b := newTestDB()
+	for _, data := range [][]byte{
+		nil,
+		[]byte("not a mmdb file"),
+		b[:len(b)/2],
+		newTestDBWithoutData(16, 1),     // data section starts inside the metadata marker
+		newTestDBWithoutData(16, 1<<63), // tree size overflows
+	} {
+		if _, err := FromBytes(data); !errors.Is(err, ErrInvalidDatabase) {
+			t.Fatalf("invalid data was loaded, err: %v", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// queryPaddingBlockSize is the recommended block size of padded queries.
+// See RFC 8467 4.1.
+const queryPaddingBlockSize = 128
+
+// padMsg pads m to a multiple of blockSize with the EDNS0 padding option (RFC 7830).
+// m.Extra will be replaced by a new slice and the OPT record in it will be
+// a copy, so it is safe to call padMsg on a shadow copy of a msg.
+// If m has no OPT record, a new one will be added.
+func padMsg(m *dns.Msg, blockSize int) {
+	extra := make([]dns.RR, 0, len(m.Extra)+1)
+	var opt *dns.OPT
+	for _, rr := range m.Extra {
+		if old, ok := rr.(*dns.OPT); ok {
+			opt = &dns.OPT{Hdr: old.Hdr, Option: removePaddingOption(old.Option)}
+			rr = opt
+		}
+		extra = append(extra, rr)
+	}
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		extra = append(extra, opt)
+	}
+	m.Extra = extra
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if l := m.Len() % blockSize; l != 0 {
+		padding.Padding = make([]byte, blockSize-l)
+	}
+}
+
+// stripPadding removes EDNS0 padding options from m.
+func stripPadding(m *dns.Msg) {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.Option = removePaddingOption(opt.Option)
+	}
+}
+
+func removePaddingOption(options []dns.EDNS0) []dns.EDNS0 {
+	s := make([]dns.EDNS0, 0, len(options))
+	for _, o := range options {
+		if o.Option() != dns.EDNS0PADDING {
+			s = append(s, o)
+		}
+	}
+	return s
+}
+
+// writePaddedMsgToTCP pads m and writes it to c. See padMsg.
+func writePaddedMsgToTCP(c io.Writer, m *dns.Msg) (n int, err error) {
+	padMsg(m, queryPaddingBlockSize)
+	return writeMsgToTCP(c, m)
+}
+
+// readUnpaddedMsgFromTCP is like readMsgFromTCP but also strips the padding of m.
+func readUnpaddedMsgFromTCP(c io.Reader) (m *dns.Msg, brokenDataLeft int, n int, err error) {
+	m, brokenDataLeft, n, err = readMsgFromTCP(c)
+	if m != nil {
+		stripPadding(m)
+	}
+	return
+}
@@ -0,0 +1,72 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_padMsg(t *testing.T) {
+	for _, name := range []string{"a.com.", "a-very-long-domain-name-that-needs-more-padding-blocks.example.com."} {
+		for _, withOPT := range []bool{false, true} {
+			q := new(dns.Msg)
+			q.SetQuestion(name, dns.TypeA)
+			if withOPT {
+				q.SetEdns0(1232, true)
+				q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 3)})
+			}
+			before, err := q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			padded := new(dns.Msg)
+			*padded = *q // shadow copy
+			padMsg(padded, queryPaddingBlockSize)
+			b, err := padded.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b)%queryPaddingBlockSize != 0 {
+				t.Fatalf("%s: padded msg length %d is not a multiple of %d", name, len(b), queryPaddingBlockSize)
+			}
+			if opt := padded.IsEdns0(); opt == nil || (withOPT && (opt.UDPSize() != 1232 || !opt.Do())) {
+				t.Fatalf("%s: invalid OPT in padded msg: %v", name, opt)
+			}
+
+			// the original msg should not be changed.
+			after, err := q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, after) {
+				t.Fatalf("%s: the original msg is changed", name)
+			}
+
+			stripPadding(padded)
+			for _, o := range padded.IsEdns0().Option {
+				if o.Option() == dns.EDNS0PADDING {
+					t.Fatalf("%s: padding is not stripped", name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/pool"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoisoningDetectionWait = time.Millisecond * 200
+
+	// the rtt floor is measured after this many confirmed replies.
+	rttFloorMinSamples = 10
+)
+
+// poisoningDetector detects poisoned local replies, e.g. replies that
+// injected by the GFW.
+type poisoningDetector struct {
+	wait     time.Duration // how long to wait for the remote reply
+	bogusIPs ipMatcher     // can be nil
+	minRTT   time.Duration // fixed rtt floor, 0 means it will be measured
+
+	sync.Mutex
+	rttMin     time.Duration // min rtt of confirmed replies
+	rttSamples int
+}
+
+// remoteReply shares the remote reply with the local query.
+type remoteReply struct {
+	done chan struct{}
+	r    *dns.Msg // nil if the remote server failed, valid after done is closed.
+}
+
+func newRemoteReply() *remoteReply {
+	return &remoteReply{done: make(chan struct{})}
+}
+
+func (rr *remoteReply) set(r *dns.Msg) {
+	rr.r = r
+	close(rr.done)
+}
+
+// rttFloor returns the min rtt of a genuine local reply. Injected replies
+// usually come back faster than it. 0 means unknown.
+func (p *poisoningDetector) rttFloor() time.Duration {
+	if p.minRTT > 0 {
+		return p.minRTT
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.rttSamples < rttFloorMinSamples {
+		return 0
+	}
+	return p.rttMin
+}
+
+func (p *poisoningDetector) addConfirmedRTT(rtt time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if p.rttSamples == 0 || rtt < p.rttMin {
+		p.rttMin = rtt
+	}
+	p.rttSamples++
+}
+
+// check checks the local reply r of q. It waits the remote reply at most
+// p.wait. It returns the reason if r is likely poisoned.
+func (p *poisoningDetector) check(ctx context.Context, q, r *dns.Msg, rtt time.Duration, remote *remoteReply) (reason string) {
+	localIPs := answerIPs(r)
+	if p.bogusIPs != nil {
+		for _, ip := range localIPs {
+			if p.bogusIPs.Contains(ip) {
+				return fmt.Sprintf("ip %s is known bogus", ip)
+			}
+		}
+	}
+	if len(q.Question) == 1 {
+		for _, rr := range r.Answer {
+			if t := rr.Header().Rrtype; (t == dns.TypeA || t == dns.TypeAAAA) && t != q.Question[0].Qtype {
+				return fmt.Sprintf("%s record for a %s question", dns.TypeToString[t], dns.TypeToString[q.Question[0].Qtype])
+			}
+		}
+	}
+	// A fast reply is only suspicious. It is reported only if the remote
+	// reply disagrees as well.
+	floor := p.rttFloor()
+	tooFast := floor > 0 && rtt < floor
+
+	timer := pool.GetTimer(p.wait)
+	defer pool.ReleaseTimer(timer)
+	select {
+	case <-remote.done:
+	case <-timer.C:
+		return "" // no remote reply to compare with
+	case <-ctx.Done():
+		return ""
+	}
+
+	reason, agree := compareReplies(r, remote.r)
+	if agree {
+		p.addConfirmedRTT(rtt)
+		return ""
+	}
+	if len(reason) == 0 && tooFast && len(localIPs) != 0 && remote.r != nil &&
+		remote.r.Rcode == dns.RcodeSuccess && len(answerIPs(remote.r)) != 0 {
+		return fmt.Sprintf("rtt %s is faster than the floor %s and remote has different ips", rtt, floor)
+	}
+	return reason
+}
+
+// compareReplies compares the local and the remote reply. agree is true if
+// they have at least one same ip. Different ips are normal (e.g. CDN), only
+// differences that suggest injection are reported as the reason.
+func compareReplies(local, remote *dns.Msg) (reason string, agree bool) {
+	if remote == nil {
+		return "", false
+	}
+	localIPs := answerIPs(local)
+	if len(localIPs) == 0 {
+		return "", false
+	}
+
+	remoteIPs := answerIPs(remote)
+	for _, lip := range localIPs {
+		for _, rip := range remoteIPs {
+			if lip.Equal(rip) {
+				return "", true
+			}
+		}
+	}
+
+	switch {
+	case remote.Rcode == dns.RcodeNameError:
+		return "remote says the name does not exist", false
+	case remote.Rcode != dns.RcodeSuccess:
+		return "", false // remote failed, can't compare
+	case len(remoteIPs) == 0 && !hasCNAME(remote):
+		return "remote says the name has no address", false
+	case hasCNAME(remote) && !hasCNAME(local):
+		return "remote has a CNAME chain but local has none", false
+	}
+	return "", false
+}
+
+func answerIPs(r *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
+
+func hasCNAME(r *dns.Msg) bool {
+	for _, rr := range r.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			return true
+		}
+	}
+	return false
+}
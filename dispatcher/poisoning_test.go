@@ -0,0 +1,189 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+
+	"github.com/miekg/dns"
+)
+
+// cnameUpstream is a fakeUpstream that replies a CNAME chain.
+type cnameUpstream struct {
+	fakeUpstream
+}
+
+func (u *cnameUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.fakeUpstream.Exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "cdn.example.com."}
+	r.Answer[0].Header().Name = cname.Target
+	r.Answer = append([]dns.RR{cname}, r.Answer...)
+	return r, nil
+}
+
+func Test_dispatcher_poisoningDetection(t *testing.T) {
+	bogusIPs, err := iptrie.LoadFromReader(bytes.NewReader([]byte("0.0.0.1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		p      *poisoningDetector
+		ll, rl time.Duration
+		remote Upstream
+		want   uint8
+	}{
+		{"bogus ip", &poisoningDetector{wait: time.Second, bogusIPs: bogusIPs}, 0, time.Millisecond * 50, nil, wantRemote},
+		{"different ips", &poisoningDetector{wait: time.Second}, 0, time.Millisecond * 50, nil, wantLocal},
+		{"remote cname", &poisoningDetector{wait: time.Second}, 0, time.Millisecond * 50, &cnameUpstream{fakeUpstream{latency: time.Millisecond * 50, ip: ip("0.0.0.2")}}, wantRemote},
+		{"too fast", &poisoningDetector{wait: time.Second, minRTT: time.Millisecond * 100}, 0, time.Millisecond * 50, nil, wantRemote},
+		{"too fast but remote too slow", &poisoningDetector{wait: time.Millisecond * 50, minRTT: time.Millisecond * 100}, 0, time.Millisecond * 500, nil, wantLocal},
+		{"remote too slow", &poisoningDetector{wait: time.Millisecond * 50}, 0, time.Millisecond * 500, &cnameUpstream{fakeUpstream{latency: time.Millisecond * 500, ip: ip("0.0.0.2")}}, wantLocal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lIP, rIP := ip("0.0.0.1"), ip("0.0.0.2")
+			d, err := initTestDispatcherAndServer(tt.ll, tt.rl, lIP, rIP, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.local.poisoningDetector = tt.p
+			if tt.remote != nil {
+				d.remote.client = tt.remote
+				d.defaultRoute = d.newDefaultRoute()
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, err := d.ServeDNS(context.Background(), nil, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := r.Answer[len(r.Answer)-1].(*dns.A)
+			w := lIP
+			if tt.want == wantRemote {
+				w = rIP
+			}
+			if !a.A.Equal(w) {
+				t.Fatalf("want %s, got %s", w, a.A)
+			}
+		})
+	}
+}
+
+func Test_compareReplies(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	reply := func(rcode int, rrs ...string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		for _, s := range rrs {
+			r.Answer = append(r.Answer, mustNewRR(s))
+		}
+		return r
+	}
+	local := reply(dns.RcodeSuccess, "example.com. 300 IN A 1.1.1.1", "example.com. 300 IN A 2.2.2.2")
+
+	tests := []struct {
+		name       string
+		remote     *dns.Msg
+		wantReject bool
+		wantAgree  bool
+	}{
+		{"remote failed", nil, false, false},
+		{"same ip", reply(dns.RcodeSuccess, "example.com. 300 IN A 2.2.2.2"), false, true},
+		{"different ip", reply(dns.RcodeSuccess, "example.com. 300 IN A 3.3.3.3"), false, false},
+		{"nxdomain", reply(dns.RcodeNameError), true, false},
+		{"servfail", reply(dns.RcodeServerFailure), false, false},
+		{"no address", reply(dns.RcodeSuccess), true, false},
+		{"cname", reply(dns.RcodeSuccess, "example.com. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN A 3.3.3.3"), true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, agree := compareReplies(local, tt.remote)
+			if (len(reason) != 0) != tt.wantReject || agree != tt.wantAgree {
+				t.Fatalf("want reject %v agree %v, got reason %q agree %v", tt.wantReject, tt.wantAgree, reason, agree)
+			}
+		})
+	}
+}
+
+func Test_poisoningDetector_rttFloor(t *testing.T) {
+	p := new(poisoningDetector)
+	for i := 0; i < rttFloorMinSamples-1; i++ {
+		p.addConfirmedRTT(time.Millisecond * 40)
+	}
+	if f := p.rttFloor(); f != 0 {
+		t.Fatalf("floor should be unknown before enough samples, got %s", f)
+	}
+	p.addConfirmedRTT(time.Millisecond * 30)
+	if f := p.rttFloor(); f != time.Millisecond*30 {
+		t.Fatalf("want floor 30ms, got %s", f)
+	}
+	p.addConfirmedRTT(time.Millisecond * 50)
+	if f := p.rttFloor(); f != time.Millisecond*30 {
+		t.Fatalf("want floor 30ms, got %s", f)
+	}
+}
+
+func Test_poisoningDetector_fastReply(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	reply := func(rr string) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, mustNewRR(rr))
+		return r
+	}
+	local := reply("example.com. 300 IN A 1.1.1.1")
+
+	tests := []struct {
+		name       string
+		remote     *dns.Msg // nil means the remote never replies
+		wantReject bool
+	}{
+		{"remote agrees", reply("example.com. 300 IN A 1.1.1.1"), false},
+		{"remote timeout", nil, false},
+		{"remote disagrees", reply("example.com. 300 IN A 2.2.2.2"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &poisoningDetector{wait: time.Millisecond * 50}
+			for i := 0; i < rttFloorMinSamples; i++ {
+				p.addConfirmedRTT(time.Millisecond * 40)
+			}
+			remote := newRemoteReply()
+			if tt.remote != nil {
+				remote.set(tt.remote)
+			}
+			reason := p.check(context.Background(), q, local, time.Millisecond*5, remote)
+			if (len(reason) != 0) != tt.wantReject {
+				t.Fatalf("want reject %v, got reason %q", tt.wantReject, reason)
+			}
+		})
+	}
+}
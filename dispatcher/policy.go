@@ -18,10 +18,19 @@
 package dispatcher
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/listbin"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/v2data"
 	netlist "github.com/IrineSistiana/net-list"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -64,7 +73,18 @@ type ipPolicies struct {
 
 type ipPolicy struct {
 	action policyAction
-	list   *netlist.List
+	list   ipMatcher
+}
+
+// ipMatcher matches ips. *iptrie.Trie is a ipMatcher.
+type ipMatcher interface {
+	Contains(ip net.IP) bool
+}
+
+// ipList is a ipMatcher that loaded from a list.
+type ipList interface {
+	ipMatcher
+	Len() int
 }
 
 type domainPolicies struct {
@@ -73,7 +93,13 @@ type domainPolicies struct {
 
 type domainPolicy struct {
 	action policyAction
-	list   *domainlist.List
+	list   domainMatcher
+}
+
+// domainMatcher matches domains. *domainlist.List is a domainMatcher.
+type domainMatcher interface {
+	Match(fqdn string) (domainlist.Rule, bool)
+	Len() int
 }
 
 func convPoliciesStr(s string, f map[string]policyAction) ([]rawPolicy, error) {
@@ -100,7 +126,8 @@ func convPoliciesStr(s string, f map[string]policyAction) ([]rawPolicy, error) {
 	return ps, nil
 }
 
-func newIPPolicies(psString string, entry *logrus.Entry) (*ipPolicies, error) {
+// newIPPolicies parses psString and loads ip lists. rl is used to load lists from urls.
+func newIPPolicies(psString string, rl *remoteListLoader, entry *logrus.Entry) (*ipPolicies, error) {
 	psArgs, err := convPoliciesStr(psString, convIPPolicyActionStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid ip policies string, %w", err)
@@ -113,14 +140,12 @@ func newIPPolicies(psString string, entry *logrus.Entry) (*ipPolicies, error) {
 		p := ipPolicy{}
 		p.action = psArgs[i].action
 
-		file := psArgs[i].args
-		if len(file) != 0 {
-			list, err := netlist.NewListFromFile(file)
+		if file := psArgs[i].args; len(file) != 0 {
+			m, err := loadIPMatcher(file, rl, entry)
 			if err != nil {
-				return nil, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+				return nil, err
 			}
-			p.list = list
-			entry.Infof("newIPPolicies: ip list %s loaded, length %d", file, list.Len())
+			p.list = m
 		}
 
 		ps.policies = append(ps.policies, p)
@@ -129,8 +154,239 @@ func newIPPolicies(psString string, entry *logrus.Entry) (*ipPolicies, error) {
 	return ps, nil
 }
 
+// loadIPMatcher loads an ip matcher from file. file can be a mmdb matcher,
+// an url, or anything that loadIPList supports. rl is used to load lists from urls.
+func loadIPMatcher(file string, rl *remoteListLoader, entry *logrus.Entry) (ipMatcher, error) {
+	if mmdbFile, field, values, ok := splitMMDBArgs(file); ok {
+		m, err := newMMDBIPMatcher(mmdbFile, field, values, entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load mmdb file from %s, %w", mmdbFile, err)
+		}
+		entry.Infof("loadIPMatcher: mmdb %s loaded, matching %s %v", mmdbFile, field, values)
+		return m, nil
+	}
+
+	var list ipList
+	var err error
+	if isListURL(file) {
+		list, err = rl.loadIPList(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip list from %s, %w", file, err)
+		}
+	} else {
+		list, err = loadIPList(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+		}
+	}
+	entry.Infof("loadIPMatcher: ip list %s loaded, length %d", file, list.Len())
+	return list, nil
+}
+
+// ipMatcherGroup matches an ip if any of its matchers matches it.
+type ipMatcherGroup []ipMatcher
+
+// newIPMatcherGroup loads ip matchers from s. s is a list of files
+// separated by "|", see loadIPMatcher.
+func newIPMatcherGroup(s string, rl *remoteListLoader, entry *logrus.Entry) (ipMatcherGroup, error) {
+	var g ipMatcherGroup
+	for _, file := range strings.Split(s, "|") {
+		if len(file) == 0 {
+			continue
+		}
+		m, err := loadIPMatcher(file, rl, entry)
+		if err != nil {
+			return nil, err
+		}
+		g = append(g, m)
+	}
+	return g, nil
+}
+
+func (g ipMatcherGroup) Contains(ip net.IP) bool {
+	for _, m := range g {
+		if m.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// netList is an ipMatcher over a sorted *netlist.List.
+type netList struct {
+	*netlist.List
+}
+
+func (l netList) Contains(ip net.IP) bool {
+	ipv6, err := netlist.Conv(ip)
+	if err != nil {
+		return false
+	}
+	return l.List.Contains(ipv6)
+}
+
+// loadNetList loads CIDR text files separated by "|" into one netList.
+func loadNetList(s string) (netList, error) {
+	list := netlist.NewNetList()
+	for _, file := range strings.Split(s, "|") {
+		if len(file) == 0 {
+			continue
+		}
+		l, err := netlist.NewListFromFile(file)
+		if err != nil {
+			return netList{}, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+		}
+		list.Merge(l)
+	}
+	list.Sort()
+	return netList{List: list}, nil
+}
+
+// splitV2DataArgs splits s into a v2ray .dat file path and a tag.
+// e.g. "geoip.dat:cn" -> ("geoip.dat", "cn", true).
+func splitV2DataArgs(s string) (file, tag string, ok bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i == -1 || !strings.HasSuffix(s[:i], ".dat") {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// loadIPList loads a ip list from s. s can be a path to a text file, a compiled
+// list file, or a path to a v2ray geoip.dat file and a tag, e.g. "geoip.dat:cn".
+func loadIPList(s string) (ipList, error) {
+	if file, tag, ok := splitV2DataArgs(s); ok {
+		return v2data.LoadGeoIP(file, tag)
+	}
+	compiled, err := listbin.IsCompiledFile(s)
+	if err != nil {
+		return nil, err
+	}
+	if compiled {
+		return listbin.OpenIPList(s)
+	}
+	return iptrie.LoadFromFile(s)
+}
+
+// loadDomainList loads a domain list from s. s can be a path to a text file, a compiled
+// list file, or a path to a v2ray geosite.dat file and a tag, e.g. "geosite.dat:cn".
+func loadDomainList(s string) (domainMatcher, error) {
+	if file, tag, ok := splitV2DataArgs(s); ok {
+		return v2data.LoadGeoSite(file, tag)
+	}
+	compiled, err := listbin.IsCompiledFile(s)
+	if err != nil {
+		return nil, err
+	}
+	if compiled {
+		return listbin.OpenDomainList(s)
+	}
+	return domainlist.LoadFormFile(s)
+}
+
+// CompileList compiles the text domain list or ip list src and saves it to dst.
+// isIPList indicates src is an ip list.
+func CompileList(src, dst string, isIPList bool) error {
+	var compile func(w io.Writer) error
+	if isIPList {
+		l, err := iptrie.LoadFromFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to load ip list, %w", err)
+		}
+		compile = func(w io.Writer) error { return listbin.CompileIPList(l, w) }
+	} else {
+		l, err := domainlist.LoadFormFile(src)
+		if err != nil {
+			return fmt.Errorf("failed to load domain list, %w", err)
+		}
+		compile = func(w io.Writer) error { return listbin.CompileDomainList(l, w) }
+	}
+
+	// write to a temp file first, so a failed compile won't leave a broken dst.
+	f, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op after the rename
+
+	w := bufio.NewWriter(f)
+	if err := compile(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// loadDomainMatcher loads a domain list from file. file can be an url, or
+// anything that loadDomainList supports. rl is used to load lists from urls.
+func loadDomainMatcher(file string, rl *remoteListLoader, entry *logrus.Entry) (domainMatcher, error) {
+	var list domainMatcher
+	var err error
+	if isListURL(file) {
+		list, err = rl.loadDomainList(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain list from %s, %w", file, err)
+		}
+	} else {
+		list, err = loadDomainList(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain file from %s, %w", file, err)
+		}
+	}
+	entry.Infof("loadDomainMatcher: domain list %s loaded, length %d", file, list.Len())
+	return list, nil
+}
+
+// domainMatcherGroup matches a domain if any of its matchers matches it.
+type domainMatcherGroup []domainMatcher
+
+// newDomainMatcherGroup loads domain lists from s. s is a list of files
+// separated by "|", see loadDomainMatcher.
+func newDomainMatcherGroup(s string, rl *remoteListLoader, entry *logrus.Entry) (domainMatcherGroup, error) {
+	var g domainMatcherGroup
+	for _, file := range strings.Split(s, "|") {
+		if len(file) == 0 {
+			continue
+		}
+		m, err := loadDomainMatcher(file, rl, entry)
+		if err != nil {
+			return nil, err
+		}
+		g = append(g, m)
+	}
+	return g, nil
+}
+
+func (g domainMatcherGroup) Match(fqdn string) (domainlist.Rule, bool) {
+	for _, m := range g {
+		if r, ok := m.Match(fqdn); ok {
+			return r, true
+		}
+	}
+	return domainlist.Rule{}, false
+}
+
+func (g domainMatcherGroup) Len() int {
+	var n int
+	for _, m := range g {
+		n += m.Len()
+	}
+	return n
+}
+
 // ps can not be nil
-func (ps *ipPolicies) check(ip netlist.IPv6) policyAction {
+func (ps *ipPolicies) check(ip net.IP) policyAction {
 	for p := range ps.policies {
 		if ps.policies[p].action == policyActionDenyAll {
 			return policyActionDeny
@@ -144,7 +400,8 @@ func (ps *ipPolicies) check(ip netlist.IPv6) policyAction {
 	return policyActionMissing
 }
 
-func newDomainPolicies(psString string, entry *logrus.Entry) (*domainPolicies, error) {
+// newDomainPolicies parses psString and loads domain lists. rl is used to load lists from urls.
+func newDomainPolicies(psString string, rl *remoteListLoader, entry *logrus.Entry) (*domainPolicies, error) {
 	psArgs, err := convPoliciesStr(psString, convDomainPolicyActionStr)
 	if err != nil {
 		return nil, fmt.Errorf("invalid domain policies string, %w", err)
@@ -157,14 +414,12 @@ func newDomainPolicies(psString string, entry *logrus.Entry) (*domainPolicies, e
 		p := domainPolicy{}
 		p.action = psArgs[i].action
 
-		file := psArgs[i].args
-		if len(file) != 0 {
-			list, err := domainlist.LoadFormFile(file)
+		if file := psArgs[i].args; len(file) != 0 {
+			list, err := loadDomainMatcher(file, rl, entry)
 			if err != nil {
-				return nil, fmt.Errorf("failed to load domain file from %s, %w", file, err)
+				return nil, err
 			}
 			p.list = list
-			entry.Infof("newDomainPolicies: domain list %s loaded, length %d", file, list.Len())
 		}
 
 		ps.policies = append(ps.policies, p)
@@ -173,17 +428,20 @@ func newDomainPolicies(psString string, entry *logrus.Entry) (*domainPolicies, e
 	return ps, nil
 }
 
-// check: ps can not be nil
-func (ps *domainPolicies) check(fqdn string) policyAction {
+// check: ps can not be nil. r is the matched rule if the action is not
+// policyActionMissing or policyActionDenyAll.
+func (ps *domainPolicies) check(fqdn string) (a policyAction, r domainlist.Rule) {
 	for p := range ps.policies {
 		if ps.policies[p].action == policyActionDenyAll {
-			return policyActionDeny
+			return policyActionDeny, r
 		}
 
-		if ps.policies[p].list != nil && ps.policies[p].list.Has(fqdn) {
-			return ps.policies[p].action
+		if ps.policies[p].list != nil {
+			if r, ok := ps.policies[p].list.Match(fqdn); ok {
+				return ps.policies[p].action, r
+			}
 		}
 	}
 
-	return policyActionMissing
+	return policyActionMissing, r
 }
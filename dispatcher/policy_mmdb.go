@@ -0,0 +1,178 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/mmdb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mmdbReloadCheckInterval = time.Minute
+)
+
+// mmdbFields are the supported fields in mmdb ip policies and
+// their paths in GeoLite2 and DB-IP databases.
+var mmdbFields = map[string][]string{
+	"country": {"country", "iso_code"},
+	"asn":     {"autonomous_system_number"},
+}
+
+// mmdbIPMatcher matches ips by a field in a mmdb database.
+// It checks the database file periodically and reloads it if it was updated.
+type mmdbIPMatcher struct {
+	file   string
+	path   []string
+	values map[string]struct{}
+	entry  *logrus.Entry
+
+	sync.RWMutex
+	r       *mmdb.Reader
+	modTime time.Time
+}
+
+// splitMMDBArgs splits s into a mmdb file path, a field and values.
+// e.g. "GeoLite2-Country.mmdb:country:CN,HK" -> ("GeoLite2-Country.mmdb", "country", ["CN", "HK"], true).
+func splitMMDBArgs(s string) (file, field string, values []string, ok bool) {
+	i := strings.LastIndex(s, ".mmdb:")
+	if i == -1 {
+		return "", "", nil, false
+	}
+	file = s[:i+len(".mmdb")]
+	fv := strings.SplitN(s[i+len(".mmdb:"):], ":", 2)
+	if len(fv) != 2 {
+		return "", "", nil, false
+	}
+	return file, fv[0], strings.Split(fv[1], ","), true
+}
+
+func newMMDBIPMatcher(file, field string, values []string, entry *logrus.Entry) (*mmdbIPMatcher, error) {
+	path, ok := mmdbFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unsupported mmdb field [%s]", field)
+	}
+
+	m := &mmdbIPMatcher{
+		file:   file,
+		path:   path,
+		values: make(map[string]struct{}, len(values)),
+		entry:  entry,
+	}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		if field == "asn" {
+			v = strings.TrimPrefix(strings.ToUpper(v), "AS")
+			if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid asn [%s]", v)
+			}
+		}
+		m.values[strings.ToUpper(v)] = struct{}{}
+	}
+	if len(m.values) == 0 {
+		return nil, fmt.Errorf("no %s value is specified", field)
+	}
+
+	if _, err := m.reload(); err != nil {
+		return nil, err
+	}
+	go m.reloadLoop()
+	return m, nil
+}
+
+// reload reopens the database if its modification time was changed.
+func (m *mmdbIPMatcher) reload() (reloaded bool, err error) {
+	fi, err := os.Stat(m.file)
+	if err != nil {
+		return false, err
+	}
+
+	m.RLock()
+	unchanged := m.r != nil && fi.ModTime().Equal(m.modTime)
+	m.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	r, err := mmdb.Open(m.file)
+	if err != nil {
+		return false, err
+	}
+
+	m.Lock()
+	old := m.r
+	m.r = r
+	m.modTime = fi.ModTime()
+	m.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return true, nil
+}
+
+func (m *mmdbIPMatcher) reloadLoop() {
+	ticker := time.NewTicker(mmdbReloadCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := m.reload()
+		if err != nil {
+			m.entry.Warnf("mmdbIPMatcher: failed to reload %s: %v", m.file, err)
+			continue
+		}
+		if reloaded {
+			m.entry.Infof("mmdbIPMatcher: %s reloaded", m.file)
+		}
+	}
+}
+
+func (m *mmdbIPMatcher) Contains(ip net.IP) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	v, ok, err := m.r.LookupPath(ip, m.path...)
+	if err != nil {
+		m.entry.Warnf("mmdbIPMatcher: lookup %s in %s: %v", ip, m.file, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = strings.ToUpper(v)
+	case uint64:
+		s = strconv.FormatUint(v, 10)
+	default:
+		return false
+	}
+	_, ok = m.values[s]
+	return ok
+}
@@ -0,0 +1,44 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_splitMMDBArgs(t *testing.T) {
+	tests := []struct {
+		s          string
+		wantFile   string
+		wantField  string
+		wantValues []string
+		wantOk     bool
+	}{
+		{"GeoLite2-Country.mmdb:country:CN,HK", "GeoLite2-Country.mmdb", "country", []string{"CN", "HK"}, true},
+		{`C:\geo\asn.mmdb:asn:4134`, `C:\geo\asn.mmdb`, "asn", []string{"4134"}, true},
+		{"GeoLite2-Country.mmdb:country", "", "", nil, false},
+		{"chn.list", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		file, field, values, ok := splitMMDBArgs(tt.s)
+		if file != tt.wantFile || field != tt.wantField || !reflect.DeepEqual(values, tt.wantValues) || ok != tt.wantOk {
+			t.Fatalf("splitMMDBArgs(%s) = %s %s %v %v", tt.s, file, field, values, ok)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/v2data"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultListUpdateInterval = time.Hour * 24
+	listDownloadTimeout       = time.Second * 60
+	listDownloadMaxSize       = 64 << 20
+)
+
+// isListURL reports whether s is a http(s) url of a remote list.
+func isListURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// remoteListLoader downloads policy lists from urls, keeps a local cache
+// of them, and refreshes them periodically.
+type remoteListLoader struct {
+	interval time.Duration
+	cacheDir string
+	client   *http.Client
+	entry    *logrus.Entry
+}
+
+func newRemoteListLoader(interval time.Duration, cacheDir, proxyURL string, entry *logrus.Entry) (*remoteListLoader, error) {
+	if interval <= 0 {
+		interval = defaultListUpdateInterval
+	}
+	if len(cacheDir) == 0 {
+		cacheDir = "."
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+	if len(proxyURL) != 0 {
+		contextDialer, err := newProxyDialer("tcp", proxyURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init proxy dialer: %v", err)
+		}
+		transport.Proxy = nil
+		transport.DialContext = contextDialer.DialContext
+	}
+
+	return &remoteListLoader{
+		interval: interval,
+		cacheDir: cacheDir,
+		client:   &http.Client{Transport: transport, Timeout: listDownloadTimeout},
+		entry:    entry,
+	}, nil
+}
+
+// remoteList is a list that downloaded from a url.
+// The list in use is swapped atomically after a successful update.
+type remoteList struct {
+	loader    *remoteListLoader
+	url       string
+	tag       string // tag for v2ray dat files
+	cacheFile string
+	load      func(file, tag string) (interface{}, error)
+
+	// validators of the cached file
+	meta remoteListMeta
+
+	sync.RWMutex
+	list interface{}
+}
+
+type remoteListMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (l *remoteListLoader) newRemoteList(s string, load func(file, tag string) (interface{}, error)) (*remoteList, error) {
+	rawURL, tag := s, ""
+	if u, t, ok := splitV2DataArgs(s); ok {
+		rawURL, tag = u, t
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
+	rl := &remoteList{
+		loader:    l,
+		url:       rawURL,
+		tag:       tag,
+		cacheFile: l.cacheFile(u, tag),
+		load:      load,
+	}
+
+	if b, err := ioutil.ReadFile(rl.metaFile()); err == nil {
+		json.Unmarshal(b, &rl.meta)
+	}
+
+	// use the cache first, so an offline start won't be blocked by the download.
+	if list, err := rl.load(rl.cacheFile, rl.tag); err == nil {
+		rl.swap(list)
+		l.entry.Infof("remoteList: using cached %s, %s will be updated in the background", rl.cacheFile, rl.url)
+		go func() {
+			if err := rl.update(); err != nil {
+				l.entry.Warnf("remoteList: failed to update %s: %v", rl.url, err)
+			}
+			rl.updateLoop()
+		}()
+		return rl, nil
+	}
+
+	if err := rl.update(); err != nil {
+		return nil, fmt.Errorf("failed to download the list and no valid cache: %w", err)
+	}
+	go rl.updateLoop()
+	return rl, nil
+}
+
+// cacheFile returns the cache file of the list at u with tag. Lists with
+// different tags have their own cache and meta files, so their validators
+// won't clobber each other.
+func (l *remoteListLoader) cacheFile(u *url.URL, tag string) string {
+	h := sha256.Sum256([]byte(u.String() + "\x00" + tag))
+	name := hex.EncodeToString(h[:8])
+	if base := path.Base(u.Path); base != "/" && base != "." {
+		name = name + "-" + base
+	}
+	return filepath.Join(l.cacheDir, name)
+}
+
+func (rl *remoteList) metaFile() string {
+	return rl.cacheFile + ".meta"
+}
+
+func (rl *remoteList) updateLoop() {
+	ticker := time.NewTicker(rl.loader.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := rl.update(); err != nil {
+			rl.loader.entry.Warnf("remoteList: failed to update %s: %v", rl.url, err)
+		}
+	}
+}
+
+// update downloads the list if it was modified, and swaps it into use.
+func (rl *remoteList) update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), listDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rl.url, nil)
+	if err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(rl.cacheFile)
+	hasCache := statErr == nil
+	if hasCache {
+		if len(rl.meta.ETag) != 0 {
+			req.Header.Set("If-None-Match", rl.meta.ETag)
+		}
+		if len(rl.meta.LastModified) != 0 {
+			req.Header.Set("If-Modified-Since", rl.meta.LastModified)
+		}
+	}
+
+	resp, err := rl.loader.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && hasCache:
+		rl.RLock()
+		loaded := rl.list != nil
+		rl.RUnlock()
+		if loaded {
+			return nil
+		}
+		list, err := rl.load(rl.cacheFile, rl.tag)
+		if err != nil {
+			return fmt.Errorf("invalid cache: %w", err)
+		}
+		rl.swap(list)
+		rl.loader.entry.Infof("remoteList: %s is not modified, cache loaded", rl.url)
+		return nil
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("bad http status codes %d", resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(rl.loader.cacheDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(rl.loader.cacheDir, filepath.Base(rl.cacheFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if it was renamed
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, listDownloadMaxSize+1))
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+	if n > listDownloadMaxSize {
+		return fmt.Errorf("list is larger than %d bytes", listDownloadMaxSize)
+	}
+
+	// make sure the new list is valid before replacing the cache.
+	list, err := rl.load(tmp.Name(), rl.tag)
+	if err != nil {
+		return fmt.Errorf("invalid list: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), rl.cacheFile); err != nil {
+		closeList(list)
+		return err
+	}
+	rl.meta = remoteListMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	if b, err := json.Marshal(rl.meta); err == nil {
+		ioutil.WriteFile(rl.metaFile(), b, 0644)
+	}
+
+	rl.swap(list)
+	rl.loader.entry.Infof("remoteList: %s updated", rl.url)
+	return nil
+}
+
+func (rl *remoteList) swap(list interface{}) {
+	rl.Lock()
+	old := rl.list
+	rl.list = list
+	rl.Unlock()
+	closeList(old)
+}
+
+// closeList closes memory-mapped lists.
+func closeList(list interface{}) {
+	if c, ok := list.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// remoteIPList is a ipList backed by a remoteList.
+type remoteIPList struct {
+	*remoteList
+}
+
+func (l *remoteListLoader) loadIPList(s string) (*remoteIPList, error) {
+	rl, err := l.newRemoteList(s, func(file, tag string) (interface{}, error) {
+		if len(tag) != 0 {
+			return v2data.LoadGeoIP(file, tag)
+		}
+		return loadIPList(file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteIPList{remoteList: rl}, nil
+}
+
+func (l *remoteIPList) Contains(ip net.IP) bool {
+	l.RLock()
+	defer l.RUnlock()
+	return l.list.(ipList).Contains(ip)
+}
+
+func (l *remoteIPList) Len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.list.(ipList).Len()
+}
+
+// remoteDomainList is a domainMatcher backed by a remoteList.
+type remoteDomainList struct {
+	*remoteList
+}
+
+func (l *remoteListLoader) loadDomainList(s string) (*remoteDomainList, error) {
+	rl, err := l.newRemoteList(s, func(file, tag string) (interface{}, error) {
+		if len(tag) != 0 {
+			return v2data.LoadGeoSite(file, tag)
+		}
+		return loadDomainList(file)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteDomainList{remoteList: rl}, nil
+}
+
+func (l *remoteDomainList) Match(fqdn string) (domainlist.Rule, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.list.(domainMatcher).Match(fqdn)
+}
+
+func (l *remoteDomainList) Len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.list.(domainMatcher).Len()
+}
@@ -0,0 +1,164 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_remoteList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var l sync.Mutex
+	body, etag, failed := "1.0.0.0/24\n", `"v1"`, false
+	var notModified int
+	var hang chan struct{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		if h := hang; h != nil {
+			l.Unlock()
+			<-h
+			return
+		}
+		defer l.Unlock()
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(body))
+	}))
+	defer s.Close()
+
+	loader, err := newRemoteListLoader(time.Hour, dir, "", logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listURL := s.URL + "/ip.list"
+
+	rl, err := loader.loadIPList(listURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl.Contains(net.ParseIP("1.0.0.1")) {
+		t.Fatal("list was not loaded")
+	}
+
+	// not modified
+	if err := rl.update(); err != nil {
+		t.Fatal(err)
+	}
+	l.Lock()
+	if notModified != 1 {
+		t.Fatal("conditional request was not sent")
+	}
+	l.Unlock()
+
+	// modified
+	l.Lock()
+	body, etag = "2.0.0.0/24\n", `"v2"`
+	l.Unlock()
+	if err := rl.update(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Contains(net.ParseIP("1.0.0.1")) || !rl.Contains(net.ParseIP("2.0.0.1")) {
+		t.Fatal("list was not updated")
+	}
+
+	// invalid list should not replace the current one
+	l.Lock()
+	body, etag = "invalid list\n", `"v3"`
+	l.Unlock()
+	if err := rl.update(); err == nil {
+		t.Fatal("invalid list was accepted")
+	}
+	if !rl.Contains(net.ParseIP("2.0.0.1")) {
+		t.Fatal("current list was replaced by an invalid list")
+	}
+
+	// server failed, a new loader should use the cache
+	l.Lock()
+	failed = true
+	l.Unlock()
+	rl2, err := loader.loadIPList(listURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rl2.Contains(net.ParseIP("2.0.0.1")) {
+		t.Fatal("cache was not used")
+	}
+
+	// a slow server should not block the start if there is a cache.
+	l.Lock()
+	hang = make(chan struct{})
+	l.Unlock()
+	start := time.Now()
+	rl3, err := loader.loadIPList(listURL)
+	close(hang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the start was blocked by the download")
+	}
+	if !rl3.Contains(net.ParseIP("2.0.0.1")) {
+		t.Fatal("cache was not used")
+	}
+	l.Lock()
+	hang = nil
+	l.Unlock()
+
+	// no cache, no list
+	if _, err := loader.loadDomainList(s.URL + "/domain.list"); err == nil {
+		t.Fatal("a list without cache was loaded")
+	}
+}
+
+func Test_remoteListLoader_cacheFile(t *testing.T) {
+	loader := &remoteListLoader{cacheDir: "cache"}
+	u, err := url.Parse("https://example.com/geoip.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, us := loader.cacheFile(u, "cn"), loader.cacheFile(u, "us")
+	if cn == us {
+		t.Fatal("lists with different tags should not share the cache file")
+	}
+	if cn != loader.cacheFile(u, "cn") {
+		t.Fatal("cache file should be stable")
+	}
+}
@@ -0,0 +1,124 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_loadCompiledLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	domainText := filepath.Join(dir, "domain.list")
+	ipText := filepath.Join(dir, "ip.list")
+	if err := ioutil.WriteFile(domainText, []byte("cn\nfull:example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ipText, []byte("1.0.0.0/24\n2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileList(domainText, domainText+".bin", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileList(ipText, ipText+".bin", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed compile keeps the old file.
+	badText := filepath.Join(dir, "bad.list")
+	if err := ioutil.WriteFile(badText, []byte("keyword:"+strings.Repeat("x", 70000)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompileList(badText, domainText+".bin", false); err == nil || !strings.Contains(err.Error(), "is too long") {
+		t.Fatalf("want an error for a too long rule, got %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(files) != 0 {
+		t.Fatalf("temp files are left: %v", files)
+	}
+
+	for _, file := range []string{domainText, domainText + ".bin"} {
+		l, err := loadDomainList(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := l.Match("a.cn."); !ok {
+			t.Fatalf("%s: a.cn. should be matched", file)
+		}
+		if _, ok := l.Match("a.example.com."); ok {
+			t.Fatalf("%s: a.example.com. should not be matched", file)
+		}
+	}
+
+	for _, file := range []string{ipText, ipText + ".bin"} {
+		l, err := loadIPList(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.Contains(net.ParseIP("2001:db8::1")) {
+			t.Fatalf("%s: 2001:db8::1 should be matched", file)
+		}
+		if l.Contains(net.ParseIP("1.0.1.0")) {
+			t.Fatalf("%s: 1.0.1.0 should not be matched", file)
+		}
+	}
+}
+
+func Test_loadNetList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v4 := filepath.Join(dir, "v4.list")
+	v6 := filepath.Join(dir, "v6.list")
+	if err := ioutil.WriteFile(v4, []byte("# lan\n192.168.0.0/16\n10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(v6, []byte("fd00::/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := loadNetList(v4 + "|" + v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"192.168.1.1", "10.0.0.1", "fd00::1"} {
+		if !l.Contains(net.ParseIP(s)) {
+			t.Fatalf("%s should be matched", s)
+		}
+	}
+	for _, s := range []string{"10.0.0.2", "8.8.8.8", "2001:db8::1"} {
+		if l.Contains(net.ParseIP(s)) {
+			t.Fatalf("%s should not be matched", s)
+		}
+	}
+
+	if _, err := loadNetList(filepath.Join(dir, "missing.list")); err == nil {
+		t.Fatal("missing file should be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyURL returns the proxy url of sc. The legacy socks5 setting will be
+// converted to a socks5 url. An empty string means no proxy.
+func (sc *BasicServerConfig) proxyURL() (string, error) {
+	return mergeProxySettings(sc.Proxy, sc.Socks5)
+}
+
+func mergeProxySettings(proxyURL, socks5 string) (string, error) {
+	if len(socks5) == 0 {
+		return proxyURL, nil
+	}
+	if len(proxyURL) != 0 {
+		return "", errors.New("proxy and socks5 can not be set at the same time")
+	}
+	addr, auth, err := parseSocks5Addr(socks5)
+	if err != nil {
+		return "", err
+	}
+	u := &url.URL{Scheme: "socks5", Host: addr}
+	if auth != nil {
+		u.User = url.UserPassword(auth.User, auth.Password)
+	}
+	return u.String(), nil
+}
+
+// newProxyDialer returns a proxy.ContextDialer that dials connections of network
+// through the proxy at proxyURL. Supported schemes are:
+//
+//	socks5://[user:pass@]host:port, supports tcp and udp (UDP ASSOCIATE).
+//	http://[user:pass@]host:port, HTTP CONNECT, supports tcp only.
+//
+// Shadowsocks is not supported, use the local socks5 or http proxy of
+// a Shadowsocks client instead.
+// opts will be applied to connections to the proxy server.
+func newProxyDialer(network, proxyURL string, opts *dialerOptions) (proxy.ContextDialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy address: %w", err)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{User: u.User.Username()}
+		auth.Password, _ = u.User.Password()
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if network == "udp" {
+			return &socks5UDPDialer{addr: u.Host, auth: auth, opts: opts}, nil
+		}
+		return newSocks5ContextDialer(network, u.Host, auth, opts.dialer("tcp"))
+	case "http":
+		if network != "tcp" {
+			return nil, fmt.Errorf("http proxy does not support %s", network)
+		}
+		return &httpConnectDialer{addr: u.Host, auth: auth, opts: opts}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme [%s]", u.Scheme)
+	}
+}
+
+// httpConnectDialer dials tcp connections through a http proxy with the CONNECT method.
+type httpConnectDialer struct {
+	addr string
+	auth *proxy.Auth
+	opts *dialerOptions
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	c, err := d.opts.dialer("tcp").DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else {
+		c.SetDeadline(time.Now().Add(dialTCPTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	br, err := d.connect(c, address)
+	if err != nil {
+		c.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("http proxy: %w", err)
+	}
+	if !stop() { // ctx is done
+		c.Close()
+		return nil, ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
+
+	if br.Buffered() > 0 { // the proxy has sent some data after the response
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+func (d *httpConnectDialer) connect(c net.Conn, address string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(d.auth.User + ":" + d.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", address, resp.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn is a net.Conn that reads from r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,208 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"container/list"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultRateLimitIPv4Prefix = 24
+	defaultRateLimitIPv6Prefix = 56
+	defaultRateLimitMaxClients = 65536
+	defaultRRLSlip             = 2
+)
+
+// rrlAction is the action to take on a response.
+type rrlAction uint8
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip // send a truncated response instead, so the client can retry over tcp.
+)
+
+// rateLimiter limits queries per client and identical responses to the
+// same client (response rate limiting, like BIND's RRL). Clients are
+// aggregated by ip prefixes.
+type rateLimiter struct {
+	v4Mask net.IPMask
+	v6Mask net.IPMask
+
+	qps     float64
+	burst   float64
+	clients *bucketTable // nil if query rate limiting is disabled
+
+	rrlRate  float64
+	rrlBurst float64
+	rrlSlip  int
+	rrlTable *bucketTable // nil if response rate limiting is disabled
+}
+
+// newRateLimiter returns a rateLimiter. qps and responsesPerSecond can be 0,
+// which disables the query rate limiting and the response rate limiting.
+// maxClients bounds the number of tracked clients and responses.
+func newRateLimiter(v4Prefix, v6Prefix int, maxClients int, qps float64, burst int, responsesPerSecond float64, slip int) *rateLimiter {
+	l := &rateLimiter{
+		v4Mask:   net.CIDRMask(v4Prefix, 32),
+		v6Mask:   net.CIDRMask(v6Prefix, 128),
+		qps:      qps,
+		burst:    float64(burst),
+		rrlRate:  responsesPerSecond,
+		rrlBurst: responsesPerSecond,
+		rrlSlip:  slip,
+	}
+	if l.burst < qps {
+		l.burst = qps
+	}
+	// a bucket needs at least one token, or fractional rates will deny everything.
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if l.rrlBurst < 1 {
+		l.rrlBurst = 1
+	}
+	if qps > 0 {
+		l.clients = newBucketTable(maxClients)
+	}
+	if responsesPerSecond > 0 {
+		l.rrlTable = newBucketTable(maxClients)
+	}
+	return l
+}
+
+// clientKey returns the prefix of ip.
+func (l *rateLimiter) clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(l.v4Mask))
+	}
+	return string(ip.To16().Mask(l.v6Mask))
+}
+
+// allowQuery reports whether a query from ip is allowed.
+func (l *rateLimiter) allowQuery(ip net.IP) bool {
+	if l.clients == nil || ip == nil {
+		return true
+	}
+	ok, _ := l.clients.take(l.clientKey(ip), time.Now(), l.qps, l.burst)
+	return ok
+}
+
+// checkResponse returns the action to take on response r to ip.
+// Identical responses are responses with the same rcode, name and type.
+func (l *rateLimiter) checkResponse(ip net.IP, r *dns.Msg) rrlAction {
+	if l.rrlTable == nil || ip == nil || len(r.Question) != 1 {
+		return rrlSend
+	}
+
+	sb := new(strings.Builder)
+	sb.WriteString(l.clientKey(ip))
+	sb.WriteString(strconv.Itoa(r.Rcode))
+	sb.WriteByte('|')
+	sb.WriteString(strconv.Itoa(int(r.Question[0].Qtype)))
+	sb.WriteByte('|')
+	sb.WriteString(strings.ToLower(r.Question[0].Name))
+
+	ok, limited := l.rrlTable.take(sb.String(), time.Now(), l.rrlRate, l.rrlBurst)
+	switch {
+	case ok:
+		return rrlSend
+	case l.rrlSlip > 0 && limited%l.rrlSlip == 0:
+		return rrlSlip
+	default:
+		return rrlDrop
+	}
+}
+
+// newSlipReply returns an empty truncated reply to q.
+func newSlipReply(q *dns.Msg) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Truncated = true
+	return r
+}
+
+// bucketTable is a set of token buckets. Its size is bounded, the least
+// recently used bucket will be removed if it's full.
+type bucketTable struct {
+	sync.Mutex
+	max     int
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	last    time.Time
+	limited int // how many times the bucket is empty
+}
+
+func newBucketTable(max int) *bucketTable {
+	return &bucketTable{
+		max:     max,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// take takes a token from the bucket of key. It returns false if the bucket
+// is empty, and how many times it has been empty.
+func (t *bucketTable) take(key string, now time.Time, rate, burst float64) (ok bool, limited int) {
+	t.Lock()
+	defer t.Unlock()
+
+	var b *tokenBucket
+	if e, ok := t.buckets[key]; ok {
+		t.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	} else {
+		if t.lru.Len() >= t.max {
+			oldest := t.lru.Back()
+			t.lru.Remove(oldest)
+			delete(t.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		t.buckets[key] = t.lru.PushFront(b)
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, b.limited
+	}
+	b.limited++
+	return false, b.limited
+}
+
+func (t *bucketTable) len() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.lru.Len()
+}
@@ -0,0 +1,125 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_bucketTable(t *testing.T) {
+	tb := newBucketTable(2)
+	now := time.Now()
+
+	// burst
+	for i := 0; i < 3; i++ {
+		if ok, _ := tb.take("a", now, 1, 3); !ok {
+			t.Fatalf("token %d should be available", i)
+		}
+	}
+	if ok, limited := tb.take("a", now, 1, 3); ok || limited != 1 {
+		t.Fatalf("bucket should be empty, got ok %v limited %d", ok, limited)
+	}
+
+	// refill
+	if ok, _ := tb.take("a", now.Add(time.Second), 1, 3); !ok {
+		t.Fatal("bucket should be refilled")
+	}
+
+	// bounded, "a" is the least recently used one.
+	tb.take("b", now, 1, 3)
+	tb.take("c", now, 1, 3)
+	if n := tb.len(); n != 2 {
+		t.Fatalf("want 2 buckets, got %d", n)
+	}
+	if _, ok := tb.buckets["a"]; ok {
+		t.Fatal("the least recently used bucket should be removed")
+	}
+}
+
+func Test_rateLimiter(t *testing.T) {
+	l := newRateLimiter(24, 56, 16, 2, 0, 0, 0)
+	if !l.allowQuery(ip("1.2.3.1")) || !l.allowQuery(ip("1.2.3.2")) {
+		t.Fatal("queries should be allowed")
+	}
+	// same /24
+	if l.allowQuery(ip("1.2.3.3")) {
+		t.Fatal("query should be limited")
+	}
+	if !l.allowQuery(ip("1.2.4.1")) || !l.allowQuery(ip("2001:db8::1")) {
+		t.Fatal("other clients should be allowed")
+	}
+	// same /56
+	if !l.allowQuery(ip("2001:db8:0:ff::1")) || l.allowQuery(ip("2001:db8::2")) {
+		t.Fatal("ipv6 clients should be aggregated by /56")
+	}
+
+	// rrl
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	l = newRateLimiter(24, 56, 16, 0, 0, 1, 2)
+	if !l.allowQuery(ip("1.2.3.1")) {
+		t.Fatal("query rate limiting should be disabled")
+	}
+	want := []rrlAction{rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, w := range want {
+		if a := l.checkResponse(ip("1.2.3.1"), r); a != w {
+			t.Fatalf("response %d: want action %d, got %d", i, w, a)
+		}
+	}
+	// different response
+	r.Rcode = dns.RcodeNameError
+	if a := l.checkResponse(ip("1.2.3.1"), r); a != rrlSend {
+		t.Fatalf("different response should be sent, got %d", a)
+	}
+
+	// never slip
+	l = newRateLimiter(24, 56, 16, 0, 0, 1, 0)
+	l.checkResponse(ip("1.2.3.1"), r)
+	for i := 0; i < 4; i++ {
+		if a := l.checkResponse(ip("1.2.3.1"), r); a != rrlDrop {
+			t.Fatalf("want drop, got %d", a)
+		}
+	}
+}
+
+func Test_rateLimiter_fractionalRate(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	l := newRateLimiter(24, 56, 16, 0.5, 0, 0.5, 0)
+	if !l.allowQuery(ip("1.2.3.1")) {
+		t.Fatal("first query should be allowed")
+	}
+	if l.allowQuery(ip("1.2.3.1")) {
+		t.Fatal("second query should be limited")
+	}
+	if a := l.checkResponse(ip("1.2.3.1"), r); a != rrlSend {
+		t.Fatalf("first response should be sent, got %d", a)
+	}
+	if a := l.checkResponse(ip("1.2.3.1"), r); a != rrlDrop {
+		t.Fatalf("second response should be dropped, got %d", a)
+	}
+}
@@ -0,0 +1,118 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+
+	netlist "github.com/IrineSistiana/net-list"
+	"github.com/miekg/dns"
+)
+
+const (
+	rebindingActionStrip  = "strip"
+	rebindingActionRefuse = "refuse"
+)
+
+// rebindingRanges are private, loopback and link-local networks that
+// public names should not resolve to.
+var rebindingRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// rebindingFilter removes private addresses from replies to protect
+// clients from DNS rebinding attacks.
+type rebindingFilter struct {
+	private   netList
+	allowlist domainMatcher // can be nil
+	refuse    bool          // refuse the whole reply, otherwise strip the addresses.
+}
+
+func newRebindingFilter(action string, allowlist domainMatcher) (*rebindingFilter, error) {
+	f := &rebindingFilter{private: netList{List: netlist.NewNetList()}, allowlist: allowlist}
+	switch action {
+	case rebindingActionStrip, "":
+	case rebindingActionRefuse:
+		f.refuse = true
+	default:
+		return nil, fmt.Errorf("unknown rebinding protection action [%s]", action)
+	}
+
+	for _, s := range rebindingRanges {
+		n, err := netlist.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.private.Append(n)
+	}
+	f.private.Sort()
+	return f, nil
+}
+
+// filter checks r, the reply of q. It returns a description of what it did
+// if r was modified.
+func (f *rebindingFilter) filter(q, r *dns.Msg) (msg string) {
+	if len(q.Question) != 1 {
+		return ""
+	}
+	if f.allowlist != nil {
+		if _, ok := f.allowlist.Match(q.Question[0].Name); ok {
+			return ""
+		}
+	}
+
+	answer := r.Answer[:0]
+	var stripped int
+	for _, rr := range r.Answer {
+		var isPrivate bool
+		switch rr := rr.(type) {
+		case *dns.A:
+			isPrivate = f.private.Contains(rr.A)
+		case *dns.AAAA:
+			isPrivate = f.private.Contains(rr.AAAA)
+		}
+		if isPrivate {
+			stripped++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	if stripped == 0 {
+		return ""
+	}
+
+	r.AuthenticatedData = false
+	if f.refuse {
+		r.Rcode = dns.RcodeRefused
+		r.Answer = nil
+		r.Ns = nil
+		return "refused"
+	}
+	r.Answer = answer
+	return fmt.Sprintf("%d private address(es) stripped", stripped)
+}
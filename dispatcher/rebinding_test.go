@@ -0,0 +1,97 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+
+	"github.com/miekg/dns"
+)
+
+func Test_rebindingFilter(t *testing.T) {
+	allowlist, err := domainlist.LoadFormReader(bytes.NewReader([]byte("lan.example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		action     string
+		qname      string
+		answer     []string
+		wantRcode  int
+		wantAnswer int
+	}{
+		{"public", rebindingActionStrip, "example.com.", []string{"example.com. 300 IN A 1.1.1.1"}, dns.RcodeSuccess, 1},
+		{"strip", rebindingActionStrip, "example.com.", []string{"example.com. 300 IN A 1.1.1.1", "example.com. 300 IN A 192.168.1.1"}, dns.RcodeSuccess, 1},
+		{"strip loopback", rebindingActionStrip, "example.com.", []string{"example.com. 300 IN A 127.0.0.1"}, dns.RcodeSuccess, 0},
+		{"strip v6", rebindingActionStrip, "example.com.", []string{"example.com. 300 IN AAAA fe80::1", "example.com. 300 IN AAAA ::1"}, dns.RcodeSuccess, 0},
+		{"strip v4 mapped", rebindingActionStrip, "example.com.", []string{"example.com. 300 IN AAAA ::ffff:10.0.0.1"}, dns.RcodeSuccess, 0},
+		{"refuse", rebindingActionRefuse, "example.com.", []string{"example.com. 300 IN A 1.1.1.1", "example.com. 300 IN A 169.254.0.1"}, dns.RcodeRefused, 0},
+		{"allowlist", rebindingActionRefuse, "lan.example.com.", []string{"lan.example.com. 300 IN A 192.168.1.1"}, dns.RcodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newRebindingFilter(tt.action, allowlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, dns.TypeA)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			for _, s := range tt.answer {
+				r.Answer = append(r.Answer, mustNewRR(s))
+			}
+			f.filter(q, r)
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAnswer {
+				t.Fatalf("want rcode %d with %d answers, got %v", tt.wantRcode, tt.wantAnswer, r)
+			}
+		})
+	}
+
+	if _, err := newRebindingFilter("unknown", nil); err == nil {
+		t.Fatal("unknown action should be rejected")
+	}
+}
+
+func Test_dispatcher_rebinding(t *testing.T) {
+	d, err := initTestDispatcherAndServer(0, 0, nil, ip("192.168.1.1"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.local.client = nil // only remote
+	d.defaultRoute = d.newDefaultRoute()
+	if d.rebinding, err = newRebindingFilter(rebindingActionStrip, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := d.ServeDNS(context.Background(), nil, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 0 {
+		t.Fatalf("private address from remote should be stripped, got %v", r.Answer)
+	}
+}
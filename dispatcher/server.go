@@ -32,8 +32,13 @@ const (
 )
 
 // ListenAndServe listen on a port and start the server. Only support tcp and udp network.
+// maxUDPSize is the max size of udp replies, it will also be advertised in
+// the OPT record of replies. It must be in [512, 65535].
 // Will always return a non-nil err.
 func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error {
+	if maxUDPSize < dns.MinMsgSize || maxUDPSize > dns.MaxMsgSize {
+		return fmt.Errorf("invalid max udp size %d, it must be in [%d, %d]", maxUDPSize, dns.MinMsgSize, dns.MaxMsgSize)
+	}
 
 	switch network {
 	case "tcp":
@@ -56,6 +61,12 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 				}
 			}
 
+			refused := !d.clientAllowed(c.RemoteAddr())
+			if refused && d.acl.drop {
+				c.Close()
+				continue
+			}
+
 			go func() {
 				defer c.Close()
 				tcpConnCtx, cancel := context.WithCancel(context.Background())
@@ -67,18 +78,28 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 					if err != nil {
 						return // read err, close the conn
 					}
+					if !d.queryAllowed(c.RemoteAddr()) {
+						continue
+					}
 
 					go func() {
-						queryCtx, cancel := context.WithTimeout(tcpConnCtx, queryTimeout)
+						queryCtx, cancel := context.WithTimeout(tcpConnCtx, d.queryTimeout)
 						defer cancel()
 
 						requestLogger := pool.GetRequestLogger(d.entry.Logger, q)
 						defer pool.ReleaseRequestLogger(requestLogger)
 
-						r, err := d.ServeDNS(queryCtx, q)
-						if err != nil {
-							requestLogger.Warnf("query failed, %v", err)
-							return // ignore it, result is empty
+						var r *dns.Msg
+						var err error
+						if refused {
+							r = newRefusedReply(q)
+						} else {
+							r, err = d.ServeDNS(queryCtx, c.RemoteAddr(), q)
+							if err != nil {
+								requestLogger.Warnf("query failed, %v", err)
+								return // ignore it, result is empty
+							}
+							setReplyEDNS0(q, r, uint16(maxUDPSize))
 						}
 
 						c.SetWriteDeadline(time.Now().Add(serverTimeout))
@@ -97,7 +118,8 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 			return err
 		}
 
-		readBuf := make([]byte, maxUDPSize)
+		// queries can be larger than our replies.
+		readBuf := make([]byte, dns.MaxMsgSize)
 		for {
 			n, from, err := l.ReadFrom(readBuf)
 			if err != nil {
@@ -117,6 +139,14 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 				continue
 			}
 
+			refused := !d.clientAllowed(from)
+			if refused && d.acl.drop {
+				continue
+			}
+			if !d.queryAllowed(from) {
+				continue
+			}
+
 			q := new(dns.Msg)
 			err = q.Unpack(readBuf[:n])
 			if err != nil {
@@ -124,16 +154,35 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 			}
 
 			go func() {
-				queryCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+				queryCtx, cancel := context.WithTimeout(context.Background(), d.queryTimeout)
 				defer cancel()
 
 				requestLogger := pool.GetRequestLogger(d.entry.Logger, q)
 				defer pool.ReleaseRequestLogger(requestLogger)
 
-				r, err := d.ServeDNS(queryCtx, q)
-				if err != nil {
-					requestLogger.Warnf("query failed, %v", err)
-					return
+				var r *dns.Msg
+				var err error
+				if refused {
+					r = newRefusedReply(q)
+				} else {
+					r, err = d.ServeDNS(queryCtx, from, q)
+					if err != nil {
+						requestLogger.Warnf("query failed, %v", err)
+						return
+					}
+					setReplyEDNS0(q, r, uint16(maxUDPSize))
+					r.Truncate(udpReplySize(q, maxUDPSize))
+				}
+
+				if d.limiter != nil {
+					switch d.limiter.checkResponse(addrIP(from), r) {
+					case rrlDrop:
+						stats.Add(statsRRLDropped, 1)
+						return
+					case rrlSlip:
+						stats.Add(statsRRLSlipped, 1)
+						r = newSlipReply(q)
+					}
 				}
 
 				buf := pool.AcquirePackBuf()
@@ -155,3 +204,50 @@ func (d *Dispatcher) ListenAndServe(network, addr string, maxUDPSize int) error
 	}
 	return fmt.Errorf("unknown network: %s", network)
 }
+
+// clientAllowed checks the client address with the acl. Rejected clients are counted.
+func (d *Dispatcher) clientAllowed(addr net.Addr) bool {
+	if d.acl == nil || d.acl.allowed(addrIP(addr)) {
+		return true
+	}
+	stats.Add(statsACLRejected, 1)
+	d.entry.Debugf("ListenAndServe: client %s is rejected by acl", addr)
+	return false
+}
+
+// queryAllowed checks the query rate of the client. Limited queries are counted.
+func (d *Dispatcher) queryAllowed(addr net.Addr) bool {
+	if d.limiter == nil || d.limiter.allowQuery(addrIP(addr)) {
+		return true
+	}
+	stats.Add(statsRateLimited, 1)
+	return false
+}
+
+// setReplyEDNS0 removes the OPT record that r got from the upstream. If the client
+// supports EDNS0, our own OPT record with udpSize will be added. See RFC 6891 7.
+func setReplyEDNS0(q, r *dns.Msg, udpSize uint16) {
+	for i := len(r.Extra) - 1; i >= 0; i-- {
+		if r.Extra[i].Header().Rrtype == dns.TypeOPT {
+			r.Extra = append(r.Extra[:i], r.Extra[i+1:]...)
+		}
+	}
+
+	qOpt := q.IsEdns0()
+	if qOpt == nil {
+		return
+	}
+	r.SetEdns0(udpSize, qOpt.Do())
+}
+
+// udpReplySize returns the max size of the udp reply that the client accepts.
+func udpReplySize(q *dns.Msg, maxUDPSize int) int {
+	size := dns.MinMsgSize
+	if opt := q.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return size
+}
@@ -0,0 +1,206 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	netlist "github.com/IrineSistiana/net-list"
+	"github.com/miekg/dns"
+)
+
+func Test_udpReplySize(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if s := udpReplySize(q, 1480); s != 512 {
+		t.Fatalf("no edns0: want 512, got %d", s)
+	}
+
+	q.SetEdns0(1232, false)
+	if s := udpReplySize(q, 1480); s != 1232 {
+		t.Fatalf("want 1232, got %d", s)
+	}
+	if s := udpReplySize(q, 1000); s != 1000 {
+		t.Fatalf("server limit: want 1000, got %d", s)
+	}
+
+	q.IsEdns0().SetUDPSize(100)
+	if s := udpReplySize(q, 1480); s != 512 {
+		t.Fatalf("small size: want 512, got %d", s)
+	}
+}
+
+func Test_setReplyEDNS0(t *testing.T) {
+	newReply := func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for i := 0; i < 100; i++ {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(1, 2, 3, byte(i)),
+			})
+		}
+		r.SetEdns0(4096, false) // from upstream
+		return r
+	}
+
+	// client without edns0
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := newReply(q)
+	setReplyEDNS0(q, r, 1480)
+	if r.IsEdns0() != nil {
+		t.Fatal("reply should not have OPT")
+	}
+	r.Truncate(udpReplySize(q, 1480))
+	if !r.Truncated {
+		t.Fatal("reply should be truncated")
+	}
+	if b, _ := r.Pack(); len(b) > 512 {
+		t.Fatalf("reply is too large: %d", len(b))
+	}
+
+	// client with edns0
+	q.SetEdns0(1232, true)
+	r = newReply(q)
+	setReplyEDNS0(q, r, 1400)
+	opt := r.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1400 || !opt.Do() {
+		t.Fatalf("unexpected OPT: %v", opt)
+	}
+	r.Truncate(udpReplySize(q, 1400))
+	if b, _ := r.Pack(); len(b) > 1232 || r.IsEdns0() == nil {
+		t.Fatalf("reply is too large or lost its OPT: %d", len(b))
+	}
+}
+
+func Test_dispatcher_acl(t *testing.T) {
+	localhost, err := netlist.NewListFromReader(bytes.NewReader([]byte("127.0.0.0/8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := netlist.NewListFromReader(bytes.NewReader([]byte("10.0.0.0/8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		allow     ipMatcher
+		deny      ipMatcher
+		action    string
+		wantRcode int // -1 means no reply
+	}{
+		{"allowed", netList{localhost}, nil, aclActionRefuse, dns.RcodeSuccess},
+		{"not in allow list", netList{other}, nil, aclActionRefuse, dns.RcodeRefused},
+		{"denied", nil, netList{localhost}, aclActionRefuse, dns.RcodeRefused},
+		{"dropped", nil, netList{localhost}, aclActionDrop, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := initTestDispatcherAndServer(0, 0, ip("0.0.0.1"), ip("0.0.0.2"), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.acl, err = newClientACL(tt.allow, tt.deny, tt.action); err != nil {
+				t.Fatal(err)
+			}
+
+			rejected := statsCounter(statsACLRejected)
+			for _, network := range []string{"udp", "tcp"} {
+				addr := freeTestAddr(t, network)
+				go d.ListenAndServe(network, addr, MaxUDPSize)
+
+				q := new(dns.Msg)
+				q.SetQuestion("example.com.", dns.TypeA)
+				c := &dns.Client{Net: network, Timeout: time.Millisecond * 200}
+				time.Sleep(time.Millisecond * 50) // wait for the server
+				r, _, err := c.Exchange(q, addr)
+				if tt.wantRcode == -1 {
+					if err == nil {
+						t.Fatalf("%s: want no reply, got %v", network, r)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", network, err)
+				}
+				if r.Rcode != tt.wantRcode {
+					t.Fatalf("%s: want rcode %d, got %d", network, tt.wantRcode, r.Rcode)
+				}
+			}
+			if counted := statsCounter(statsACLRejected) > rejected; counted != (tt.wantRcode != dns.RcodeSuccess) {
+				t.Fatalf("rejected clients are not counted correctly")
+			}
+		})
+	}
+}
+
+// freeTestAddr returns a local address that is not in use.
+func freeTestAddr(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		c, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = c.LocalAddr().String()
+		c.Close()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = l.Addr().String()
+		l.Close()
+	}
+	return addr
+}
+
+func Test_dispatcher_maxUDPSize(t *testing.T) {
+	d, err := initTestDispatcherAndServer(0, 0, ip("0.0.0.1"), ip("0.0.0.2"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 511, 65536} {
+		if err := d.ListenAndServe("udp", "127.0.0.1:0", size); err == nil {
+			t.Fatalf("want an error for max udp size %d", size)
+		}
+	}
+
+	// a small max udp size doesn't limit the size of queries.
+	addr := freeTestAddr(t, "udp")
+	go d.ListenAndServe("udp", addr, dns.MinMsgSize)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(4096, false)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1000)})
+	c := &dns.Client{Net: "udp", Timeout: time.Millisecond * 500}
+	time.Sleep(time.Millisecond * 50) // wait for the server
+	r, _, err := c.Exchange(q, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unexpected reply %v", r)
+	}
+}
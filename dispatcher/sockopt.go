@@ -0,0 +1,73 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+	"net"
+)
+
+// dialerOptions are socket options of outbound connections.
+// A nil *dialerOptions is valid and means default options.
+type dialerOptions struct {
+	localAddr net.IP
+	iface     string // SO_BINDTODEVICE
+	mark      int    // SO_MARK
+}
+
+// newDialerOptions returns nil if no option is set.
+func newDialerOptions(localAddr, iface string, mark int) (*dialerOptions, error) {
+	if len(localAddr) == 0 && len(iface) == 0 && mark == 0 {
+		return nil, nil
+	}
+
+	o := &dialerOptions{iface: iface, mark: mark}
+	if len(localAddr) != 0 {
+		o.localAddr = net.ParseIP(localAddr)
+		if o.localAddr == nil {
+			return nil, fmt.Errorf("invalid local address [%s]", localAddr)
+		}
+	}
+	if len(iface) != 0 || mark != 0 {
+		if err := checkSocketOptions(); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// dialer returns a *net.Dialer for network with options in o.
+func (o *dialerOptions) dialer(network string) *net.Dialer {
+	d := new(net.Dialer)
+	if o == nil {
+		return d
+	}
+
+	if o.localAddr != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: o.localAddr}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: o.localAddr}
+		}
+	}
+	if len(o.iface) != 0 || o.mark != 0 {
+		d.Control = controlSocket(o.iface, o.mark)
+	}
+	return d
+}
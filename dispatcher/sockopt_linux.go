@@ -0,0 +1,54 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package dispatcher
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkSocketOptions() error {
+	return nil
+}
+
+// controlSocket returns a func for net.Dialer.Control that sets SO_BINDTODEVICE and SO_MARK.
+func controlSocket(iface string, mark int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if len(iface) != 0 {
+				if err := syscall.BindToDevice(int(fd), iface); err != nil {
+					sockErr = fmt.Errorf("failed to bind to device %s: %w", iface, err)
+					return
+				}
+			}
+			if mark != 0 {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+					sockErr = fmt.Errorf("failed to set so_mark %d: %w", mark, err)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,72 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package dispatcher
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func Test_controlSocket(t *testing.T) {
+	o, err := newDialerOptions("", "lo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := o.dialer("tcp").Dial("tcp", l.Addr().String())
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("need CAP_NET_ADMIN to set so_mark")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		mark, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if mark != 1 {
+		t.Fatalf("want so_mark 1, got %d", mark)
+	}
+
+	// no such device
+	o, _ = newDialerOptions("", "not-exist-dev0", 0)
+	if _, err := o.dialer("tcp").Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("want an err")
+	}
+}
@@ -0,0 +1,138 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// addrRecorder records remote addresses of queries.
+type addrRecorder struct {
+	sync.Mutex
+	addrs []string
+}
+
+func (r *addrRecorder) record(a string) {
+	r.Lock()
+	r.addrs = append(r.addrs, a)
+	r.Unlock()
+}
+
+func (r *addrRecorder) allFrom(t *testing.T, ip net.IP) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.addrs) == 0 {
+		t.Fatal("no query was received")
+	}
+	for _, a := range r.addrs {
+		host, _, _ := net.SplitHostPort(a)
+		if !net.ParseIP(host).Equal(ip) {
+			t.Fatalf("want queries from %s, got %s", ip, a)
+		}
+	}
+	r.addrs = nil
+}
+
+func Test_upstream_localAddr(t *testing.T) {
+	localIP := net.IPv4(127, 0, 0, 2)
+	rec := new(addrRecorder)
+	vs := &vServer{ip: net.IPv4(1, 2, 3, 4)}
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		rec.record(w.RemoteAddr().String())
+		vs.ServeDNS(w, q)
+	})
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpServer := dns.Server{Net: "udp", PacketConn: udpConn, Handler: h}
+	tcpServer := dns.Server{Net: "tcp", Listener: tcpListener, Handler: h}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		sc := &BasicServerConfig{
+			Addr:      udpConn.LocalAddr().String(),
+			Protocol:  protocol,
+			LocalAddr: localIP.String(),
+		}
+		u, err := NewUpstream(sc, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangeTestQuery(t, u)
+		rec.allFrom(t, localIP)
+	}
+
+	// doh
+	dohHandler := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+	dohServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec.record(req.RemoteAddr)
+		dohHandler.ServeHTTP(w, req)
+	}))
+	dohServer.EnableHTTP2 = true
+	dohServer.StartTLS()
+	defer dohServer.Close()
+
+	sc := &BasicServerConfig{
+		Addr:               dohServer.Listener.Addr().String(),
+		Protocol:           "doh",
+		LocalAddr:          localIP.String(),
+		InsecureSkipVerify: true,
+	}
+	sc.DoH.URL = "https://example.com/dns-query"
+	u, err := NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeTestQuery(t, u)
+	rec.allFrom(t, localIP)
+}
+
+func Test_newDialerOptions(t *testing.T) {
+	if o, err := newDialerOptions("", "", 0); o != nil || err != nil {
+		t.Fatal("want nil options")
+	}
+	if _, err := newDialerOptions("not an ip", "", 0); err == nil {
+		t.Fatal("want an err")
+	}
+
+	o, err := newDialerOptions("127.0.0.2", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.dialer("udp").LocalAddr.(*net.UDPAddr); !ok {
+		t.Fatal("udp dialer should have a udp local address")
+	}
+	if _, ok := o.dialer("tcp").LocalAddr.(*net.TCPAddr); !ok {
+		t.Fatal("tcp dialer should have a tcp local address")
+	}
+}
@@ -0,0 +1,292 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5 consts. See RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoAccept = 0xff
+
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5PasswordVersion = 0x01
+)
+
+// parseSocks5Addr parses "[username:password@]host:port".
+func parseSocks5Addr(s string) (addr string, auth *proxy.Auth, err error) {
+	addr = s
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		userInfo := s[:i]
+		addr = s[i+1:]
+		userPass := strings.SplitN(userInfo, ":", 2)
+		auth = &proxy.Auth{User: userPass[0]}
+		if len(userPass) == 2 {
+			auth.Password = userPass[1]
+		}
+		if len(auth.User) == 0 || len(auth.User) > 255 || len(auth.Password) > 255 {
+			return "", nil, errors.New("invalid socks5 username or password")
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", nil, fmt.Errorf("invalid socks5 address: %w", err)
+	}
+	return addr, auth, nil
+}
+
+// newSocks5ContextDialer returns a proxy.ContextDialer that connects
+// through the socks5 server at addr.
+func newSocks5ContextDialer(network, addr string, auth *proxy.Auth, forward proxy.Dialer) (proxy.ContextDialer, error) {
+	d, err := proxy.SOCKS5(network, addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("internel err: socks5 dialer is not a proxy.ContextDialer")
+	}
+	return contextDialer, nil
+}
+
+// socks5UDPDialer dials udp "connections" through a socks5 server with UDP ASSOCIATE.
+type socks5UDPDialer struct {
+	addr string
+	auth *proxy.Auth
+	opts *dialerOptions
+}
+
+// DialContext returns a net.Conn that sends udp packets to address via the socks5 server.
+func (d *socks5UDPDialer) DialContext(ctx context.Context, _, address string) (net.Conn, error) {
+	header, err := socks5AppendAddr(make([]byte, 3, 3+1+255+2), address) // RSV RSV FRAG
+	if err != nil {
+		return nil, err
+	}
+
+	ctrl, err := d.opts.dialer("tcp").DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(deadline)
+	} else {
+		ctrl.SetDeadline(time.Now().Add(dialTCPTimeout))
+	}
+
+	relay, err := d.associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5 udp associate: %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// If the server replies with an unspecified address, use the address of the server.
+	if relay.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	c, err := d.opts.dialer("udp").DialContext(ctx, "udp", relay.String())
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return &socks5UDPConn{Conn: c, ctrl: ctrl, header: header}, nil
+}
+
+// associate does the handshake and returns the relay address.
+func (d *socks5UDPDialer) associate(c net.Conn) (*net.UDPAddr, error) {
+	// method selection
+	methods := []byte{socks5AuthNone}
+	if d.auth != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return nil, err
+	}
+	if b[0] != socks5Version {
+		return nil, fmt.Errorf("unexpected protocol version %d", b[0])
+	}
+	switch b[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.auth == nil {
+			return nil, errors.New("server requires authentication")
+		}
+		b = []byte{socks5PasswordVersion, byte(len(d.auth.User))}
+		b = append(b, d.auth.User...)
+		b = append(b, byte(len(d.auth.Password)))
+		b = append(b, d.auth.Password...)
+		if _, err := c.Write(b); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return nil, err
+		}
+		if b[1] != 0x00 {
+			return nil, errors.New("username/password authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return nil, errors.New("no acceptable authentication methods")
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %d", b[1])
+	}
+
+	// UDP ASSOCIATE with an unspecified address, we don't know our address here.
+	b = []byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return nil, err
+	}
+	if b[1] != 0x00 {
+		return nil, fmt.Errorf("server replied %d", b[1])
+	}
+
+	var ipLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		ipLen = net.IPv4len
+	case socks5AtypIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unsupported relay address type %d", b[3])
+	}
+	b = make([]byte, ipLen+2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: net.IP(b[:ipLen]), Port: int(binary.BigEndian.Uint16(b[ipLen:]))}, nil
+}
+
+// socks5AppendAddr appends the socks5 form of address to b.
+func socks5AppendAddr(b []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port [%s]", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name is too long")
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// socks5UDPConn is a udp connection to the socks5 relay. Packets written to it will
+// have a socks5 udp request header. Packets read from it will have the header removed.
+type socks5UDPConn struct {
+	net.Conn
+	ctrl   net.Conn // the association terminates when it is closed.
+	header []byte
+}
+
+func (c *socks5UDPConn) Write(b []byte) (int, error) {
+	buf := make([]byte, 0, len(c.header)+len(b))
+	buf = append(buf, c.header...)
+	buf = append(buf, b...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UDPConn) Read(b []byte) (int, error) {
+	buf := make([]byte, len(b)+len(c.header)+255)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		data, ok := socks5TrimUDPHeader(buf[:n])
+		if !ok { // broken or fragmented packet, drop it
+			continue
+		}
+		return copy(b, data), nil
+	}
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+// socks5TrimUDPHeader removes the udp request header from b.
+// Fragmented packets are not supported.
+func socks5TrimUDPHeader(b []byte) ([]byte, bool) {
+	if len(b) < 4 || b[2] != 0x00 { // FRAG must be 0
+		return nil, false
+	}
+	var addrLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		addrLen = net.IPv4len
+	case socks5AtypIPv6:
+		addrLen = net.IPv6len
+	case socks5AtypDomain:
+		if len(b) < 5 {
+			return nil, false
+		}
+		addrLen = 1 + int(b[4])
+	default:
+		return nil, false
+	}
+	headerLen := 4 + addrLen + 2
+	if len(b) < headerLen {
+		return nil, false
+	}
+	return b[headerLen:], true
+}
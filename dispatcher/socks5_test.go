@@ -0,0 +1,286 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testSocks5Server is a minimal socks5 server that supports
+// username/password authentication, CONNECT and UDP ASSOCIATE.
+type testSocks5Server struct {
+	l          net.Listener
+	user, pass string
+
+	connects, associates int32
+}
+
+func startTestSocks5Server(t *testing.T, user, pass string) *testSocks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSocks5Server{l: l, user: user, pass: pass}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *testSocks5Server) handle(c net.Conn) {
+	defer c.Close()
+
+	b := make([]byte, 512)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return
+	}
+	methods := make([]byte, b[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	want := byte(socks5AuthNone)
+	if len(s.user) != 0 {
+		want = socks5AuthPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		c.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return
+	}
+	c.Write([]byte{socks5Version, want})
+
+	if want == socks5AuthPassword {
+		if _, err := io.ReadFull(c, b[:2]); err != nil {
+			return
+		}
+		user := make([]byte, b[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, b[:1])
+		pass := make([]byte, b[0])
+		io.ReadFull(c, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			c.Write([]byte{socks5PasswordVersion, 0x01})
+			return
+		}
+		c.Write([]byte{socks5PasswordVersion, 0x00})
+	}
+
+	// request
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return
+	}
+	cmd := b[1]
+	dst, err := testReadSocks5Addr(c, b[3])
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case 0x01: // CONNECT
+		atomic.AddInt32(&s.connects, 1)
+		remote, err := net.Dial("tcp", dst)
+		if err != nil {
+			c.Write([]byte{socks5Version, 0x05, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remote.Close()
+		c.Write([]byte{socks5Version, 0x00, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(remote, c)
+		io.Copy(c, remote)
+	case socks5CmdUDPAssociate:
+		atomic.AddInt32(&s.associates, 1)
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply := []byte{socks5Version, 0x00, 0x00, socks5AtypIPv4, 127, 0, 0, 1, 0, 0}
+		binary.BigEndian.PutUint16(reply[8:], uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		c.Write(reply)
+		go s.relayUDP(relay)
+		io.Copy(ioutil.Discard, c) // the association ends when the ctrl conn is closed.
+	}
+}
+
+func (s *testSocks5Server) relayUDP(relay net.PacketConn) {
+	var client net.Addr
+	b := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() { // from client
+			client = from
+			data, ok := socks5TrimUDPHeader(b[:n])
+			if !ok {
+				continue
+			}
+			dst, err := testReadSocks5Addr(&byteReader{b: b[4:n]}, b[3])
+			if err != nil {
+				continue
+			}
+			dstAddr, err := net.ResolveUDPAddr("udp", dst)
+			if err != nil {
+				continue
+			}
+			relay.WriteTo(data, dstAddr)
+		} else { // from remote
+			header, _ := socks5AppendAddr([]byte{0, 0, 0}, from.String())
+			relay.WriteTo(append(header, b[:n]...), client)
+		}
+	}
+}
+
+type byteReader struct{ b []byte }
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+func testReadSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func Test_parseSocks5Addr(t *testing.T) {
+	tests := []struct {
+		s          string
+		addr       string
+		user, pass string
+		wantErr    bool
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080", "", "", false},
+		{"user:p@ss@127.0.0.1:1080", "127.0.0.1:1080", "user", "p@ss", false},
+		{"user@127.0.0.1:1080", "127.0.0.1:1080", "user", "", false},
+		{":pass@127.0.0.1:1080", "", "", "", true},
+		{"127.0.0.1", "", "", "", true},
+	}
+	for _, tt := range tests {
+		addr, auth, err := parseSocks5Addr(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseSocks5Addr(%s): unexpected err %v", tt.s, err)
+		}
+		if err != nil {
+			continue
+		}
+		var user, pass string
+		if auth != nil {
+			user, pass = auth.User, auth.Password
+		}
+		if addr != tt.addr || user != tt.user || pass != tt.pass {
+			t.Fatalf("parseSocks5Addr(%s) = %s, %s, %s", tt.s, addr, user, pass)
+		}
+	}
+}
+
+func Test_upstream_socks5(t *testing.T) {
+	h := &vServer{ip: net.IPv4(1, 2, 3, 4)}
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpServer := dns.Server{Net: "udp", PacketConn: udpConn, Handler: h}
+	tcpServer := dns.Server{Net: "tcp", Listener: tcpListener, Handler: h}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	s := startTestSocks5Server(t, "user", "pass")
+	defer s.l.Close()
+	proxyAddr := s.l.Addr().String()
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		sc := &BasicServerConfig{
+			Addr:     udpConn.LocalAddr().String(),
+			Protocol: protocol,
+			Socks5:   "user:pass@" + proxyAddr,
+		}
+		u, err := NewUpstream(sc, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangeTestQuery(t, u)
+	}
+	if atomic.LoadInt32(&s.associates) == 0 || atomic.LoadInt32(&s.connects) == 0 {
+		t.Fatal("queries did not go through the socks5 server")
+	}
+
+	// wrong password
+	d, err := newProxyDialer("udp", "socks5://user:wrong@"+proxyAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.DialContext(context.Background(), "udp", udpConn.LocalAddr().String()); err == nil {
+		c.Close()
+		t.Fatal("want an auth err")
+	}
+}
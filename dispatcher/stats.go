@@ -0,0 +1,40 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"expvar"
+)
+
+// stats are published by expvar, so they can be read from /debug/vars
+// if the pprof http server is enabled.
+var stats = expvar.NewMap("mos-chinadns")
+
+// keys of stats
+const (
+	statsTLSPinMismatch = "upstream_tls_pin_mismatch"
+	statsACLRejected    = "acl_rejected" // rejected tcp connections and udp queries
+	statsRateLimited    = "rate_limited_queries"
+	statsRRLDropped     = "rrl_dropped_responses"
+	statsRRLSlipped     = "rrl_slipped_responses"
+)
+
+// StatsString returns all stats in json format.
+func StatsString() string {
+	return stats.String()
+}
@@ -18,6 +18,7 @@
 package dispatcher
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -36,7 +37,6 @@ import (
 
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/pool"
 	"github.com/miekg/dns"
-	"golang.org/x/net/proxy"
 )
 
 const (
@@ -45,7 +45,6 @@ const (
 	dialUDPTimeout      = time.Second * 5
 	generalWriteTimeout = time.Second * 1
 	generalReadTimeout  = time.Second * 3
-	dohIOTimeout        = time.Second * 10
 )
 
 // Upstream represents a dns upstream
@@ -61,6 +60,9 @@ type upstreamCommon struct {
 	readMsg     func(c io.Reader) (m *dns.Msg, brokenDataLeft int, n int, err error)
 
 	cp *connPool
+
+	// truncatedFallback, if not nil, will be used when the reply is truncated.
+	truncatedFallback Upstream
 }
 
 // upstreamWithLimit represents server but has a concurrent limitation
@@ -69,6 +71,20 @@ type upstreamWithLimit struct {
 	u  Upstream
 }
 
+// upstreamWithTimeout represents server but has a query timeout
+type upstreamWithTimeout struct {
+	timeout time.Duration
+	u       Upstream
+}
+
+// timeout returns the query timeout of sc.
+func (sc *BasicServerConfig) timeout() time.Duration {
+	if sc.Timeout == 0 {
+		return defaultUpstreamTimeout
+	}
+	return time.Duration(sc.Timeout) * time.Millisecond
+}
+
 // NewUpstream inits a upstream instance base on the config.
 // maxConcurrentQueries limits the max concurrent queries for this upstream. 0 means disable the limit.
 // rootCAs will be used in dot/doh upstream in tls server verification.
@@ -77,48 +93,63 @@ func NewUpstream(sc *BasicServerConfig, maxConcurrentQueries int, rootCAs *x509.
 		return nil, errors.New("no server config")
 	}
 
+	proxyURL, err := sc.proxyURL()
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy settings: %v", err)
+	}
+
+	opts, err := newDialerOptions(sc.LocalAddr, sc.Interface, sc.SoMark)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket options: %v", err)
+	}
+
+	var bootstrap *bootstrapResolver
+	if len(sc.Bootstrap) != 0 {
+		bootstrap, err = newBootstrapResolver(sc.Bootstrap, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init bootstrap resolver: %v", err)
+		}
+	}
+
 	var upstream Upstream
 	switch sc.Protocol {
 	case "udp", "":
-		dialUDP := func() (net.Conn, error) {
-			return net.DialTimeout("udp", sc.Addr, dialUDPTimeout)
-		}
-		upstream = &upstreamCommon{
-			dialNewConn: dialUDP,
-			readMsg:     readMsgFromUDP,
-			writeMsg:    writeMsgToUDP,
-			cp:          newConnPool(0xffff, time.Second*10, time.Second*5),
-		}
-	case "tcp":
-		dialTCP, err := getUpstreamDialTCPFunc("tcp", sc.Addr, sc.Socks5, dialTCPTimeout)
+		dialUDP, err := getUpstreamDialTCPFunc("udp", sc.Addr, proxyURL, bootstrap, opts, dialUDPTimeout)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dialer: %v", err)
 		}
+		// retry truncated replies over tcp
+		tcpUpstream, err := newTCPUpstream(sc, proxyURL, bootstrap, opts)
+		if err != nil {
+			return nil, err
+		}
 
-		idleTimeout := time.Duration(sc.TCP.IdleTimeout) * time.Second
 		upstream = &upstreamCommon{
-			dialNewConn: dialTCP,
-			readMsg:     readMsgFromTCP,
-			writeMsg:    writeMsgToTCP,
-			cp:          newConnPool(0xffff, idleTimeout, idleTimeout>>1),
+			dialNewConn:       dialUDP,
+			readMsg:           readMsgFromUDP,
+			writeMsg:          writeMsgToUDP,
+			cp:                newConnPool(0xffff, time.Second*10, time.Second*5),
+			truncatedFallback: tcpUpstream,
 		}
+	case "tcp":
+		tcpUpstream, err := newTCPUpstream(sc, proxyURL, bootstrap, opts)
+		if err != nil {
+			return nil, err
+		}
+		upstream = tcpUpstream
 	case "dot":
 		if len(sc.DoT.ServerName) == 0 {
 			return nil, fmt.Errorf("protocol [%s] needs additional argument: server_name", sc.Protocol)
 		}
 
-		dialTCP, err := getUpstreamDialTCPFunc("tcp", sc.Addr, sc.Socks5, dialTCPTimeout)
+		dialTCP, err := getUpstreamDialTCPFunc("tcp", sc.Addr, proxyURL, bootstrap, opts, dialTCPTimeout)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dialer: %v", err)
 		}
 
-		tlsConf := &tls.Config{
-			ServerName:         sc.DoT.ServerName,
-			RootCAs:            rootCAs,
-			ClientSessionCache: tls.NewLRUClientSessionCache(64),
-
-			// for test only
-			InsecureSkipVerify: sc.InsecureSkipVerify,
+		tlsConf, err := newUpstreamTLSConfig(sc, sc.DoT.ServerName, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls config: %v", err)
 		}
 		dialTLS := func() (net.Conn, error) {
 			c, err := dialTCP()
@@ -130,43 +161,83 @@ func NewUpstream(sc *BasicServerConfig, maxConcurrentQueries int, rootCAs *x509.
 			// try handshake first
 			if err := tlsConn.Handshake(); err != nil {
 				c.Close()
-				return nil, fmt.Errorf("failed to tls handshake: %v", err)
+				return nil, fmt.Errorf("failed to tls handshake: %w", err)
 			}
 			return tlsConn, nil
 		}
 		idleTimeout := time.Duration(sc.DoT.IdleTimeout) * time.Second
 		upstream = &upstreamCommon{
 			dialNewConn: dialTLS,
-			readMsg:     readMsgFromTCP,
-			writeMsg:    writeMsgToTCP,
+			readMsg:     readUnpaddedMsgFromTCP,
+			writeMsg:    writePaddedMsgToTCP,
 			cp:          newConnPool(0xffff, idleTimeout, idleTimeout>>1),
 		}
+	case "doq":
+		if len(sc.DoQ.ServerName) == 0 {
+			return nil, fmt.Errorf("protocol [%s] needs additional argument: server_name", sc.Protocol)
+		}
+		if len(proxyURL) != 0 {
+			return nil, fmt.Errorf("protocol [%s] does not support proxy", sc.Protocol)
+		}
+		if opts != nil {
+			return nil, fmt.Errorf("protocol [%s] does not support socket options", sc.Protocol)
+		}
+
+		tlsConf, err := newUpstreamTLSConfig(sc, sc.DoQ.ServerName, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls config: %v", err)
+		}
+		upstream = newDoQUpstream(sc.Addr, tlsConf, time.Duration(sc.DoQ.IdleTimeout)*time.Second, bootstrap)
 	case "doh":
 		if len(sc.DoH.URL) == 0 {
 			return nil, fmt.Errorf("protocol [%s] needs additional argument: url", sc.Protocol)
 		}
 
-		tlsConf := &tls.Config{
-			// don't have to set servername here, net.http will do it itself.
-			RootCAs:            rootCAs,
-			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		// don't have to set servername here, net.http will do it itself.
+		tlsConf, err := newUpstreamTLSConfig(sc, "", rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init tls config: %v", err)
+		}
 
-			// for test only
-			InsecureSkipVerify: sc.InsecureSkipVerify,
+		addr := sc.Addr
+		if len(addr) == 0 { // use the host in url
+			u, err := url.Parse(sc.DoH.URL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url: %v", err)
+			}
+			addr = u.Host
+			if len(u.Port()) == 0 {
+				addr = net.JoinHostPort(u.Hostname(), "443")
+			}
 		}
 
-		dialContext, err := getUpstreamDialContextFunc("tcp", sc.Addr, sc.Socks5)
+		dialContext, err := getUpstreamDialContextFunc("tcp", addr, proxyURL, bootstrap, opts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dialContext: %v", err)
 		}
 
-		upstream, err = newDoHUpstream(sc.DoH.URL, dialContext, tlsConf)
+		doh, err := newDoHUpstream(sc.DoH.URL, sc.DoH.Method, dialContext, tlsConf)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init DoH upstream: %v", err)
 		}
+
+		if len(sc.DoH.HTTP3) != 0 {
+			if len(proxyURL) != 0 {
+				return nil, fmt.Errorf("http3 does not support proxy")
+			}
+			if opts != nil {
+				return nil, fmt.Errorf("http3 does not support socket options")
+			}
+			doh.h3, err = newDoHH3(sc.DoH.HTTP3, addr, tlsConf, bootstrap, sc.timeout())
+			if err != nil {
+				return nil, fmt.Errorf("failed to init DoH upstream: %v", err)
+			}
+		}
+		upstream = doh
 	default:
 		return nil, fmt.Errorf("unsupport protocol: %s", sc.Protocol)
 	}
+	upstream = &upstreamWithTimeout{timeout: sc.timeout(), u: upstream}
 	if maxConcurrentQueries > 0 {
 		limitedUpstream := &upstreamWithLimit{bk: newBucket(maxConcurrentQueries), u: upstream}
 		return limitedUpstream, nil
@@ -186,8 +257,33 @@ func (u *upstreamWithLimit) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Ms
 	return u.u.Exchange(ctx, q)
 }
 
+func (u *upstreamWithTimeout) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	return u.u.Exchange(ctx, q)
+}
+
+// readDeadline returns the deadline of ctx. If ctx has no deadline,
+// it's generalReadTimeout from now.
+func readDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(generalReadTimeout)
+}
+
 func (u *upstreamCommon) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-	return u.exchange(ctx, q, false)
+	r, err = u.exchange(ctx, q, false)
+	if err != nil || !r.Truncated || u.truncatedFallback == nil {
+		return r, err
+	}
+
+	rFull, err := u.truncatedFallback.Exchange(ctx, q)
+	if err != nil {
+		// the truncated reply is still a valid reply, let the client decide.
+		return r, nil
+	}
+	return rFull, nil
 }
 
 func (u *upstreamCommon) exchange(ctx context.Context, q *dns.Msg, forceNewConn bool) (r *dns.Msg, err error) {
@@ -205,7 +301,7 @@ func (u *upstreamCommon) exchange(ctx context.Context, q *dns.Msg, forceNewConn
 	if dc == nil {
 		c, err := u.dialNewConn()
 		if err != nil {
-			return nil, fmt.Errorf("failed to dial new conntion: %v", err)
+			return nil, fmt.Errorf("failed to dial new conntion: %w", err)
 		}
 		dc = newDNSConn(c, time.Now())
 		isNewConn = true
@@ -236,7 +332,7 @@ func (u *upstreamCommon) exchange(ctx context.Context, q *dns.Msg, forceNewConn
 	}
 
 	var n int
-	dc.SetReadDeadline(time.Now().Add(generalReadTimeout))
+	dc.SetReadDeadline(readDeadline(ctx))
 	// if we need to empty the conn (some data of previous reply)
 	if dc.frameLeft > 0 {
 		buf := pool.GetMsgBuf(dc.frameLeft)
@@ -438,11 +534,15 @@ func (p *connPool) disabled() bool {
 }
 
 type upstreamDoH struct {
-	preparedURL []byte
+	url         string
+	preparedURL []byte // url for GET method, ends with "dns="
+	usePost     bool
 	client      *http.Client
+	h3          *dohH3 // nil if http3 is disabled
 }
 
-func newDoHUpstream(urlStr string, dialContext func(ctx context.Context, network, address string) (net.Conn, error), tlsConfig *tls.Config) (*upstreamDoH, error) {
+// newDoHUpstream returns a DoH upstream. method can be "GET" or "POST", empty means "GET".
+func newDoHUpstream(urlStr, method string, dialContext func(ctx context.Context, network, address string) (net.Conn, error), tlsConfig *tls.Config) (*upstreamDoH, error) {
 	// check urlStr
 	u, err := url.ParseRequestURI(urlStr)
 	if err != nil {
@@ -453,6 +553,16 @@ func newDoHUpstream(urlStr string, dialContext func(ctx context.Context, network
 		return nil, fmt.Errorf("invalid url scheme [%s]", u.Scheme)
 	}
 
+	c := new(upstreamDoH)
+	switch strings.ToUpper(method) {
+	case "", http.MethodGet:
+	case http.MethodPost:
+		c.usePost = true
+	default:
+		return nil, fmt.Errorf("invalid method [%s]", method)
+	}
+	c.url = u.String()
+
 	u.ForceQuery = true // make sure we have a '?' at somewhere
 	urlStr = u.String()
 	if strings.HasSuffix(urlStr, "?") {
@@ -472,7 +582,6 @@ func newDoHUpstream(urlStr string, dialContext func(ctx context.Context, network
 
 	http2.ConfigureTransport(transport) // enable http2
 
-	c := new(upstreamDoH)
 	c.preparedURL = []byte(urlStr)
 	c.client = &http.Client{
 		Transport: transport,
@@ -481,12 +590,9 @@ func newDoHUpstream(urlStr string, dialContext func(ctx context.Context, network
 	return c, nil
 }
 
-//Exchange: dot upstream has its own context to control timeout, it will not follow the ctx.
-func (u *upstreamDoH) Exchange(_ context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-
-	ctx, cancel := context.WithTimeout(context.Background(), dohIOTimeout)
-	defer cancel()
-
+// Exchange sends q to the DoH server. The http request will be canceled
+// if ctx is done.
+func (u *upstreamDoH) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
 	// In order to maximize HTTP cache friendliness, DoH clients using media
 	// formats that include the ID field from the DNS message header, such
 	// as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
@@ -496,11 +602,37 @@ func (u *upstreamDoH) Exchange(_ context.Context, q *dns.Msg) (r *dns.Msg, err e
 	defer pool.ReleaseMsg(qWithNewID)
 	*qWithNewID = *q // shadow copy, we just want to change its ID
 	qWithNewID.Id = 0
+	padMsg(qWithNewID, queryPaddingBlockSize)
+
+	if u.usePost {
+		// http.Transport may still be reading the body after Do returns,
+		// so the body can't use a buffer from pool.
+		qRaw, packErr := qWithNewID.Pack()
+		if packErr != nil {
+			return nil, fmt.Errorf("invalid msg q: %v", packErr)
+		}
+		r, err = u.doHTTP(ctx, http.MethodPost, u.url, qRaw)
+	} else {
+		r, err = u.exchangeGET(ctx, qWithNewID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("doHTTP: %w", err)
+	}
 
+	if r.Id != 0 { // check msg id
+		return nil, dns.ErrId
+	}
+	// change the id back
+	r.Id = q.Id
+	stripPadding(r)
+	return r, nil
+}
+
+func (u *upstreamDoH) exchangeGET(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
 	buf := pool.AcquirePackBuf()
 	defer pool.ReleasePackBuf(buf)
 
-	rRaw, err := qWithNewID.PackBuffer(buf)
+	rRaw, err := q.PackBuffer(buf)
 	if err != nil {
 		return nil, fmt.Errorf("invalid msg q: %v", err)
 	}
@@ -515,28 +647,25 @@ func (u *upstreamDoH) Exchange(_ context.Context, q *dns.Msg) (r *dns.Msg, err e
 	encoder.Write(rRaw)
 	encoder.Close()
 
-	r, err = u.doHTTP(ctx, urlBuilder.String())
-	if err != nil {
-		return nil, fmt.Errorf("doHTTP: %w", err)
-	}
-
-	if r.Id != 0 { // check msg id
-		return nil, dns.ErrId
-	}
-	// change the id back
-	r.Id = q.Id
-	return r, nil
+	return u.doHTTP(ctx, http.MethodGet, urlBuilder.String(), nil)
 }
 
-func (u *upstreamDoH) doHTTP(ctx context.Context, url string) (*dns.Msg, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+func (u *upstreamDoH) doHTTP(ctx context.Context, method, url string, body []byte) (*dns.Msg, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("interal err: NewRequestWithContext: %w", err)
 	}
 
 	req.Header["Accept"] = []string{"application/dns-message"}
+	if body != nil {
+		req.Header["Content-Type"] = []string{"application/dns-message"}
+	}
 
-	resp, err := u.client.Do(req)
+	resp, err := u.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("http request failed: %w", err)
 	}
@@ -587,28 +716,78 @@ func (u *upstreamDoH) doHTTP(ctx context.Context, url string) (*dns.Msg, error)
 	return r, nil
 }
 
-func getUpstreamDialContextFunc(network, dstAddress, sock5Address string) (func(ctx context.Context, _, _ string) (net.Conn, error), error) {
-	if len(sock5Address) != 0 { // proxy through sock5
-		d, err := proxy.SOCKS5(network, sock5Address, nil, nil)
-		if err != nil {
-			return nil, fmt.Errorf("failed to init socks5 dialer: %v", err)
+// do sends req via http3 if it is available, otherwise via http2.
+// If http3 failed, do falls back to http2.
+func (u *upstreamDoH) do(req *http.Request) (*http.Response, error) {
+	if u.h3 != nil && u.h3.usable() {
+		resp, err := u.h3.client.Do(req)
+		if err == nil {
+			return resp, nil
 		}
-		contextDialer, ok := d.(proxy.ContextDialer)
-		if !ok {
-			return nil, errors.New("internel err: socks5 dialer is not a proxy.ContextDialer")
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return nil, err
+		}
+		u.h3.markFailed()
+
+		if req.GetBody != nil { // body was consumed by the first try
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if u.h3 != nil {
+		u.h3.updateAltSvc(resp.Header)
+	}
+	return resp, nil
+}
+
+// newTCPUpstream returns a tcp upstream of sc. It's also used by udp
+// upstreams to retry truncated replies.
+func newTCPUpstream(sc *BasicServerConfig, proxyURL string, bootstrap *bootstrapResolver, opts *dialerOptions) (*upstreamCommon, error) {
+	dialTCP, err := getUpstreamDialTCPFunc("tcp", sc.Addr, proxyURL, bootstrap, opts, dialTCPTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init dialer: %v", err)
+	}
+	idleTimeout := time.Duration(sc.TCP.IdleTimeout) * time.Second
+	return &upstreamCommon{
+		dialNewConn: dialTCP,
+		readMsg:     readMsgFromTCP,
+		writeMsg:    writeMsgToTCP,
+		cp:          newConnPool(0xffff, idleTimeout, idleTimeout>>1),
+	}, nil
+}
+
+// getUpstreamDialContextFunc returns a func that dials dstAddress. If bootstrap is not nil,
+// the host of dstAddress will be resolved by it, unless the connection goes through a proxy.
+// See newProxyDialer for supported proxyURL. opts can be nil.
+func getUpstreamDialContextFunc(network, dstAddress, proxyURL string, bootstrap *bootstrapResolver, opts *dialerOptions) (func(ctx context.Context, _, _ string) (net.Conn, error), error) {
+	if len(proxyURL) != 0 {
+		contextDialer, err := newProxyDialer(network, proxyURL, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init proxy dialer: %v", err)
 		}
 		return func(ctx context.Context, _, _ string) (net.Conn, error) {
 			return contextDialer.DialContext(ctx, network, dstAddress)
 		}, nil
 	}
+	if bootstrap != nil {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return bootstrap.dialContext(ctx, network, dstAddress)
+		}, nil
+	}
+	d := opts.dialer(network)
 	return func(ctx context.Context, _, _ string) (net.Conn, error) {
-		d := net.Dialer{}
 		return d.DialContext(ctx, network, dstAddress)
 	}, nil
 }
 
-func getUpstreamDialTCPFunc(network, dstAddress, sock5Address string, timeout time.Duration) (func() (net.Conn, error), error) {
-	d, err := getUpstreamDialContextFunc(network, dstAddress, sock5Address)
+func getUpstreamDialTCPFunc(network, dstAddress, proxyURL string, bootstrap *bootstrapResolver, opts *dialerOptions, timeout time.Duration) (func() (net.Conn, error), error) {
+	d, err := getUpstreamDialContextFunc(network, dstAddress, proxyURL, bootstrap, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get upstream dialTCP func: %v", err)
 	}
@@ -0,0 +1,177 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// h3FailureBackoff is how long we stop using http3 after it failed.
+	h3FailureBackoff = time.Minute * 10
+	// altSvcDefaultMaxAge is the default freshness lifetime of an Alt-Svc entry. See RFC 7838 3.1.
+	altSvcDefaultMaxAge = time.Hour * 24
+	// h3HandshakeTimeout is the max time of a http3 handshake. It's also limited
+	// to a third of the upstream timeout, so there is time left to fall back
+	// to http2 if udp is blocked.
+	h3HandshakeTimeout = time.Second
+)
+
+// dohH3 manages the http3 client of a DoH upstream.
+type dohH3 struct {
+	client *http.Client
+	force  bool // always try http3 first, don't wait for Alt-Svc
+	addr   string
+
+	sync.Mutex
+	altSvcPort   string    // port in Alt-Svc, empty if none
+	altSvcExpire time.Time // h3 is advertised until then
+	failedUntil  time.Time
+}
+
+// newDoHH3 returns a *dohH3 base on mode. mode can be "force" or "auto".
+// Queries will be sent to addr. timeout is the upstream timeout.
+func newDoHH3(mode, addr string, tlsConfig *tls.Config, bootstrap *bootstrapResolver, timeout time.Duration) (*dohH3, error) {
+	h := &dohH3{addr: addr}
+	switch mode {
+	case "force":
+		h.force = true
+	case "auto":
+	default:
+		return nil, fmt.Errorf("invalid http3 mode [%s]", mode)
+	}
+
+	handshakeTimeout := h3HandshakeTimeout
+	if t := timeout / 3; t < handshakeTimeout {
+		handshakeTimeout = t
+	}
+	transport := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: handshakeTimeout,
+		},
+		Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+			return bootstrap.dialQUIC(ctx, h.dialAddr(), tlsCfg, cfg)
+		},
+	}
+	h.client = &http.Client{Transport: transport}
+	return h, nil
+}
+
+// dialAddr returns the udp address of the server.
+func (h *dohH3) dialAddr() string {
+	h.Lock()
+	port := h.altSvcPort
+	h.Unlock()
+
+	if len(port) == 0 || h.force {
+		return h.addr
+	}
+	host, _, err := net.SplitHostPort(h.addr)
+	if err != nil {
+		return h.addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// usable reports whether http3 should be tried.
+func (h *dohH3) usable() bool {
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	if now.Before(h.failedUntil) {
+		return false
+	}
+	return h.force || now.Before(h.altSvcExpire)
+}
+
+// markFailed disables http3 for h3FailureBackoff.
+func (h *dohH3) markFailed() {
+	h.Lock()
+	h.failedUntil = time.Now().Add(h3FailureBackoff)
+	h.Unlock()
+	h.client.CloseIdleConnections()
+}
+
+// updateAltSvc updates h3 availability from the Alt-Svc header in a http2 response.
+func (h *dohH3) updateAltSvc(header http.Header) {
+	if h.force {
+		return
+	}
+	v := header.Get("Alt-Svc")
+	if len(v) == 0 {
+		return
+	}
+
+	port, maxAge, ok := parseAltSvcH3(v)
+	h.Lock()
+	defer h.Unlock()
+	if !ok { // h3 is not advertised anymore, or Alt-Svc is "clear"
+		h.altSvcPort = ""
+		h.altSvcExpire = time.Time{}
+		return
+	}
+	h.altSvcPort = port
+	h.altSvcExpire = time.Now().Add(maxAge)
+}
+
+// parseAltSvcH3 finds the "h3" entry in an Alt-Svc header value.
+// e.g. `h3=":443"; ma=86400, h3-29=":443"` returns "443", 86400s, true.
+// See RFC 7838 3.
+func parseAltSvcH3(v string) (port string, maxAge time.Duration, ok bool) {
+	for _, entry := range strings.Split(v, ",") {
+		params := strings.Split(entry, ";")
+		protoAuthority := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(protoAuthority) != 2 || protoAuthority[0] != "h3" {
+			continue
+		}
+
+		authority, err := strconv.Unquote(protoAuthority[1])
+		if err != nil {
+			continue
+		}
+		_, port, err = net.SplitHostPort(authority)
+		if err != nil {
+			continue
+		}
+
+		maxAge = altSvcDefaultMaxAge
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "ma" {
+				if sec, err := strconv.ParseUint(kv[1], 10, 32); err == nil {
+					maxAge = time.Duration(sec) * time.Second
+				}
+			}
+		}
+		return port, maxAge, true
+	}
+	return "", 0, false
+}
@@ -0,0 +1,164 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startH3Server starts a http3 server on a random udp port.
+func startH3Server(t *testing.T, h http.Handler) (addr string, closeFunc func()) {
+	cert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http3.Server{Handler: h}
+	go s.ServeListener(l)
+	return l.Addr().String(), func() { s.Close(); l.Close() }
+}
+
+func newTestDoHUpstream(t *testing.T, addr, h3Mode string) *upstreamDoH {
+	sc := &BasicServerConfig{
+		Addr:               addr,
+		Protocol:           "doh",
+		InsecureSkipVerify: true,
+	}
+	sc.DoH.URL = "https://example.com/dns-query"
+	sc.DoH.HTTP3 = h3Mode
+	u, err := NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.(*upstreamWithTimeout).u.(*upstreamDoH)
+}
+
+func exchangeTestQuery(t *testing.T, u Upstream) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), defaultUpstreamTimeout)
+	defer cancel()
+	r, err := u.Exchange(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply: %v", r)
+	}
+}
+
+func Test_upstreamDoH_http3(t *testing.T) {
+	t.Run("force", func(t *testing.T) {
+		h3Handler := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+		addr, closeH3 := startH3Server(t, h3Handler)
+		defer closeH3()
+
+		u := newTestDoHUpstream(t, addr, "force")
+		for i := 0; i < 3; i++ {
+			exchangeTestQuery(t, u)
+		}
+		if n := atomic.LoadInt32(&h3Handler.count); n != 3 {
+			t.Fatalf("want 3 queries via http3, got %d", n)
+		}
+	})
+
+	// auto: first query via http2, discover h3 from Alt-Svc, then use http3.
+	t.Run("auto", func(t *testing.T) {
+		h3Handler := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+		h3Addr, closeH3 := startH3Server(t, h3Handler)
+		defer closeH3()
+		_, h3Port, _ := net.SplitHostPort(h3Addr)
+
+		h2Handler := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+		h2Server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"; ma=60`, h3Port))
+			h2Handler.ServeHTTP(w, req)
+		}))
+		h2Server.EnableHTTP2 = true
+		h2Server.StartTLS()
+		defer h2Server.Close()
+
+		u := newTestDoHUpstream(t, h2Server.Listener.Addr().String(), "auto")
+		for i := 0; i < 3; i++ {
+			exchangeTestQuery(t, u)
+		}
+		if n := atomic.LoadInt32(&h2Handler.count); n != 1 {
+			t.Fatalf("want 1 query via http2, got %d", n)
+		}
+		if n := atomic.LoadInt32(&h3Handler.count); n != 2 {
+			t.Fatalf("want 2 queries via http3, got %d", n)
+		}
+	})
+
+	// fallback: no http3 server, queries should go through http2.
+	t.Run("fallback", func(t *testing.T) {
+		h2Handler := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+		h2Server := httptest.NewUnstartedServer(h2Handler)
+		h2Server.EnableHTTP2 = true
+		h2Server.StartTLS()
+		defer h2Server.Close()
+
+		u := newTestDoHUpstream(t, h2Server.Listener.Addr().String(), "force")
+		for i := 0; i < 3; i++ {
+			exchangeTestQuery(t, u)
+		}
+		if n := atomic.LoadInt32(&h2Handler.count); n != 3 {
+			t.Fatalf("want 3 queries via http2, got %d", n)
+		}
+		if u.h3.usable() {
+			t.Fatal("failed http3 should not be usable")
+		}
+	})
+}
+
+func Test_parseAltSvcH3(t *testing.T) {
+	tests := []struct {
+		v      string
+		port   string
+		maxAge time.Duration
+		ok     bool
+	}{
+		{`h3=":443"; ma=3600, h3-29=":443"; ma=3600`, "443", time.Hour, true},
+		{`h3-29=":443", h3=":8443"`, "8443", altSvcDefaultMaxAge, true},
+		{`h2=":443"`, "", 0, false},
+		{`clear`, "", 0, false},
+		{`h3=443`, "", 0, false},
+	}
+	for _, tt := range tests {
+		port, maxAge, ok := parseAltSvcH3(tt.v)
+		if port != tt.port || maxAge != tt.maxAge || ok != tt.ok {
+			t.Errorf("parseAltSvcH3(%q) = %s, %v, %v, want %s, %v, %v", tt.v, port, maxAge, ok, tt.port, tt.maxAge, tt.ok)
+		}
+	}
+}
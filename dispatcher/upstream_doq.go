@@ -0,0 +1,196 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/pool"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ error codes. See RFC 9250 4.3.
+const (
+	doqNoError          quic.ApplicationErrorCode = 0x0
+	doqRequestCancelled quic.StreamErrorCode      = 0x3
+)
+
+// upstreamDoQ is a DNS-over-QUIC (RFC 9250) upstream.
+// All queries share one QUIC connection, each query uses its own stream.
+type upstreamDoQ struct {
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	bootstrap  *bootstrapResolver
+
+	sync.Mutex
+	conn    *quic.Conn
+	dialing *doqDialCall // the ongoing dial, can be nil
+}
+
+// doqDialCall is a dial that is shared by all callers of getConn.
+type doqDialCall struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
+}
+
+func newDoQUpstream(addr string, tlsConfig *tls.Config, idleTimeout time.Duration, bootstrap *bootstrapResolver) *upstreamDoQ {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	if tlsConfig.ClientSessionCache == nil { // for 0-RTT resumption
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(64)
+	}
+
+	return &upstreamDoQ{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		bootstrap: bootstrap,
+		quicConfig: &quic.Config{
+			HandshakeIdleTimeout: tlsHandshakeTimeout,
+			MaxIdleTimeout:       idleTimeout,
+		},
+	}
+}
+
+// getConn returns the current connection or dials a new one.
+// If failed is the current connection, it will be closed and replaced.
+// The dial doesn't hold the lock, concurrent callers wait for the same dial.
+func (u *upstreamDoQ) getConn(ctx context.Context, failed *quic.Conn) (*quic.Conn, error) {
+	u.Lock()
+	if u.conn != nil {
+		select {
+		case <-u.conn.Context().Done(): // closed
+			u.conn = nil
+		default:
+			if u.conn != failed {
+				conn := u.conn
+				u.Unlock()
+				return conn, nil
+			}
+			u.conn.CloseWithError(doqNoError, "")
+			u.conn = nil
+		}
+	}
+
+	call := u.dialing
+	if call == nil {
+		call = &doqDialCall{done: make(chan struct{})}
+		u.dialing = call
+		go u.dial(call)
+	}
+	u.Unlock()
+
+	select {
+	case <-call.done:
+		return call.conn, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (u *upstreamDoQ) dial(call *doqDialCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialUDPTimeout)
+	defer cancel()
+	// DialAddrEarly allows us to send queries as 0-RTT data if
+	// we have a session ticket from a previous connection.
+	call.conn, call.err = u.bootstrap.dialQUIC(ctx, u.addr, u.tlsConfig, u.quicConfig)
+
+	u.Lock()
+	u.dialing = nil
+	if call.err == nil {
+		u.conn = call.conn
+	}
+	u.Unlock()
+	close(call.done)
+}
+
+func (u *upstreamDoQ) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
+	conn, err := u.getConn(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial new conntion: %w", err)
+	}
+
+	r, err = u.exchange(ctx, conn, q)
+	if err != nil && ctx.Err() == nil {
+		var idleErr *quic.IdleTimeoutError
+		var appErr *quic.ApplicationError
+		var resetErr *quic.StatelessResetError
+		if errors.As(err, &idleErr) || errors.As(err, &appErr) || errors.As(err, &resetErr) {
+			// the connection was closed, try again with a new connection.
+			conn, err = u.getConn(ctx, conn)
+			if err != nil {
+				return nil, fmt.Errorf("failed to dial new conntion: %w", err)
+			}
+			return u.exchange(ctx, conn, q)
+		}
+	}
+	return r, err
+}
+
+func (u *upstreamDoQ) exchange(ctx context.Context, conn *quic.Conn, q *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// cancel the stream if ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	})
+	defer stop()
+
+	// When sending queries over a QUIC connection, the DNS Message ID MUST be set to 0.
+	// https://tools.ietf.org/html/rfc9250 4.2.1
+	qWithNewID := pool.GetMsg()
+	defer pool.ReleaseMsg(qWithNewID)
+	*qWithNewID = *q // shadow copy, we just want to change its ID
+	qWithNewID.Id = 0
+
+	stream.SetDeadline(readDeadline(ctx))
+	// DoQ uses the same 2-octet length field as DNS over TCP.
+	if _, err := writePaddedMsgToTCP(stream, qWithNewID); err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		return nil, err
+	}
+	// The client MUST send the DNS query over the selected stream and
+	// MUST indicate through the STREAM FIN mechanism that no further
+	// data will be sent on that stream.
+	stream.Close()
+
+	r, _, _, err := readUnpaddedMsgFromTCP(stream)
+	if err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	if r.Id != 0 {
+		return nil, dns.ErrId
+	}
+	r.Id = q.Id
+	return r, nil
+}
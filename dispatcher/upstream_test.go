@@ -25,15 +25,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 )
 
 func Test_upstream(t *testing.T) {
@@ -175,12 +181,347 @@ func Test_upstream(t *testing.T) {
 		testServer.shutdowned = false
 	}()
 
-	// TODO add tests for DoH
+	// test doq
+	func() {
+		cert, err := generateCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+		l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveDoQ(l, testServer)
+
+		sc := &BasicServerConfig{
+			Addr:               l.Addr().String(),
+			Protocol:           "doq",
+			InsecureSkipVerify: true,
+		}
+		sc.DoQ.IdleTimeout = 10
+		sc.DoQ.ServerName = "example.com"
+		doqUpstream, err := NewUpstream(sc, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testUpstream("doq", doqUpstream)
+
+		// the upstream should redial if the server closed the connection.
+		u := doqUpstream.(*upstreamWithLimit).u.(*upstreamWithTimeout).u.(*upstreamDoQ)
+		u.Lock()
+		u.conn.CloseWithError(doqNoError, "")
+		u.Unlock()
+		testUpstream("doq reconnect", doqUpstream)
+
+		testServer.shutdowned = true
+		testUpstreamTimeout("doq timeout", doqUpstream)
+		testServer.shutdowned = false
+	}()
+
+}
+
+func Test_upstreamTimeout(t *testing.T) {
+	// a server that never replies.
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, protocol := range []string{"udp", "tcp"} {
+		addr := c.LocalAddr().String()
+		if protocol == "tcp" {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			addr = l.Addr().String()
+		}
+		u, err := NewUpstream(&BasicServerConfig{Addr: addr, Protocol: protocol, Timeout: 100}, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		start := time.Now()
+		if _, err := u.Exchange(context.Background(), q); err == nil {
+			t.Fatalf("%s: want an err", protocol)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("%s: exchange did not return after timeout", protocol)
+		}
+	}
+}
+
+func Test_upstreamUDP_truncated(t *testing.T) {
+	// udp replies are truncated, tcp replies are not.
+	var tcpQueries int32
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			r.Truncated = true
+		} else {
+			atomic.AddInt32(&tcpQueries, 1)
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(1, 2, 3, 4),
+			})
+		}
+		w.WriteMsg(r)
+	})
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpServer := dns.Server{Net: "udp", PacketConn: udpConn, Handler: h}
+	tcpServer := dns.Server{Net: "tcp", Listener: tcpListener, Handler: h}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	sc := &BasicServerConfig{Addr: udpConn.LocalAddr().String(), Protocol: "udp"}
+	sc.TCP.IdleTimeout = 10
+	u, err := NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		exchangeTestQuery(t, u)
+	}
+	if n := atomic.LoadInt32(&tcpQueries); n != 3 {
+		t.Fatalf("want 3 tcp queries, got %d", n)
+	}
+	if cp := u.(*upstreamWithTimeout).u.(*upstreamCommon).truncatedFallback.(*upstreamCommon).cp; len(cp.pool) != 1 {
+		t.Fatal("tcp connection should be reused")
+	}
+}
+
+func Test_upstreamDoH(t *testing.T) {
+	h := &dohTestHandler{ip: net.IPv4(1, 2, 3, 4)}
+	server := httptest.NewUnstartedServer(h)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	newUpstream := func(method string, timeout uint) Upstream {
+		sc := &BasicServerConfig{
+			Addr:               server.Listener.Addr().String(),
+			Protocol:           "doh",
+			Timeout:            timeout,
+			InsecureSkipVerify: true,
+		}
+		sc.DoH.URL = "https://example.com/dns-query"
+		sc.DoH.Method = method
+		u, err := NewUpstream(sc, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	for _, method := range []string{"GET", "POST"} {
+		exchangeTestQuery(t, newUpstream(method, 0))
+	}
+
+	// slow server
+	h.latency = time.Second * 3
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// the exchange should follow the ctx
+	u := newUpstream("POST", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	start := time.Now()
+	if _, err := u.Exchange(ctx, q); err == nil {
+		t.Fatal("want an err")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("exchange did not return after ctx was done")
+	}
+
+	// and the upstream timeout
+	u = newUpstream("GET", 1000)
+	start = time.Now()
+	if _, err := u.Exchange(context.Background(), q); err == nil {
+		t.Fatal("want an err")
+	}
+	if time.Since(start) > time.Second*2 {
+		t.Fatal("exchange did not return after timeout")
+	}
+}
+
+// dohTestHandler is a minimal DoH server.
+type dohTestHandler struct {
+	ip      net.IP
+	latency time.Duration
+	count   int32 // number of served queries
+}
+
+func (h *dohTestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = ioutil.ReadAll(req.Body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(b); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	atomic.AddInt32(&h.count, 1)
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   h.ip,
+	})
+	rRaw, err := r.Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(h.latency):
+	case <-req.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(rRaw)
+}
+
+func Test_upstreamDoQ_getConn(t *testing.T) {
+	cert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveDoQ(l, &vServer{ip: net.IPv4(1, 2, 3, 4)})
+
+	sc := &BasicServerConfig{Addr: l.Addr().String(), Protocol: "doq", InsecureSkipVerify: true}
+	sc.DoQ.ServerName = "example.com"
+	sc.DoQ.IdleTimeout = 10
+	up, err := NewUpstream(sc, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := up.(*upstreamWithTimeout).u.(*upstreamDoQ)
+
+	ctx := context.Background()
+	failed, err := u.getConn(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent callers that saw the same failed connection share one new connection.
+	conns := make([]*quic.Conn, 8)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := u.getConn(ctx, failed)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conns[i] = conn
+		}(i)
+	}
+	wg.Wait()
+	for _, conn := range conns {
+		if conn == nil || conn == failed || conn != conns[0] {
+			t.Fatal("the failed connection should be replaced by one new connection")
+		}
+	}
+	select {
+	case <-conns[0].Context().Done():
+		t.Fatal("the new connection was closed")
+	default:
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := u.Exchange(ctx, q); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveDoQ serves DoQ queries from l by h until l is closed.
+func serveDoQ(l *quic.EarlyListener, h dns.Handler) {
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					q, _, _, err := readMsgFromTCP(stream)
+					if err != nil {
+						return
+					}
+					h.ServeDNS(&doqTestResponseWriter{stream: stream, conn: conn}, q)
+				}()
+			}
+		}()
+	}
+}
+
+type doqTestResponseWriter struct {
+	stream *quic.Stream
+	conn   *quic.Conn
+}
+
+func (w *doqTestResponseWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *doqTestResponseWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w *doqTestResponseWriter) WriteMsg(m *dns.Msg) error {
+	_, err := writeMsgToTCP(w.stream, m)
+	return err
 }
+func (w *doqTestResponseWriter) Write(b []byte) (int, error) { return w.stream.Write(b) }
+func (w *doqTestResponseWriter) Close() error                { return w.stream.Close() }
+func (w *doqTestResponseWriter) TsigStatus() error           { return nil }
+func (w *doqTestResponseWriter) TsigTimersOnly(bool)         {}
+func (w *doqTestResponseWriter) Hijack()                     {}
 
 // This test tests if proxy.SOCKS5 still return a proxy.ContextDialer
 func Test_getUpstreamDialContextFunc(t *testing.T) {
-	_, err := getUpstreamDialContextFunc("tcp", "127.0.0.1:1081", "127.0.0.1:1080")
+	_, err := getUpstreamDialContextFunc("tcp", "127.0.0.1:1081", "socks5://127.0.0.1:1080", nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
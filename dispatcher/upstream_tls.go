@@ -0,0 +1,118 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errSPKIPinMismatch = errors.New("spki pin mismatch")
+
+// newUpstreamTLSConfig returns the tls config for dot/doh/doq upstreams.
+// serverName can be empty, e.g. net/http will set it itself.
+func newUpstreamTLSConfig(sc *BasicServerConfig, serverName string, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            rootCAs,
+		ClientSessionCache: tls.NewLRUClientSessionCache(64),
+
+		// for test only, or with spki pins.
+		InsecureSkipVerify: sc.InsecureSkipVerify,
+	}
+
+	if len(sc.TLS.ClientCert) != 0 || len(sc.TLS.ClientKey) != 0 {
+		cert, err := tls.LoadX509KeyPair(sc.TLS.ClientCert, sc.TLS.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(sc.TLS.SPKIPins) != 0 {
+		pins, err := parseSPKIPins(sc.TLS.SPKIPins)
+		if err != nil {
+			return nil, err
+		}
+		// VerifyConnection is called even if InsecureSkipVerify is set.
+		tlsConf.VerifyConnection = func(cs tls.ConnectionState) error {
+			// Only match certificates that the server proved to own. Others in
+			// PeerCertificates can be copies of anyone's certificates.
+			var certs []*x509.Certificate
+			if tlsConf.InsecureSkipVerify {
+				if len(cs.PeerCertificates) != 0 {
+					certs = cs.PeerCertificates[:1]
+				}
+			} else {
+				for _, chain := range cs.VerifiedChains {
+					certs = append(certs, chain...)
+				}
+			}
+			if err := verifySPKIPins(certs, pins); err != nil {
+				stats.Add(statsTLSPinMismatch, 1)
+				return err
+			}
+			return nil
+		}
+	}
+	return tlsConf, nil
+}
+
+// parseSPKIPins decodes base64 encoded SHA-256 hashes of SubjectPublicKeyInfo.
+// See RFC 7858 4.2.
+func parseSPKIPins(s []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(s))
+	for _, pin := range s {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin [%s], it should be a base64 encoded sha256 hash", pin)
+		}
+		pins = append(pins, b)
+	}
+	return pins, nil
+}
+
+// spkiPin returns the base64 encoded SHA-256 hash of cert's SubjectPublicKeyInfo.
+func spkiPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// verifySPKIPins returns nil if any of the certs matches any of the pins.
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(h[:], pin) {
+				return nil
+			}
+		}
+	}
+
+	presented := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		presented = append(presented, spkiPin(cert))
+	}
+	return fmt.Errorf("%w: server presented [%s], none of them is pinned", errSPKIPinMismatch, strings.Join(presented, ", "))
+}
@@ -0,0 +1,213 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_upstreamDoT_mTLSAndPins(t *testing.T) {
+	serverCert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeTestCertificate(t, clientCert)
+
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientLeaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			c, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if !c.Equal(clientLeaf) {
+				return errors.New("unknown client certificate")
+			}
+			return nil
+		},
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := dns.Server{Net: "tcp-tls", Listener: l, TLSConfig: tlsConfig, Handler: &vServer{ip: ip("0.0.0.1")}}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	newUpstream := func(withClientCert bool, pins ...string) Upstream {
+		sc := &BasicServerConfig{
+			Addr:               l.Addr().String(),
+			Protocol:           "dot",
+			InsecureSkipVerify: true,
+		}
+		sc.DoT.ServerName = "example.com"
+		if withClientCert {
+			sc.TLS.ClientCert = certFile
+			sc.TLS.ClientKey = keyFile
+		}
+		sc.TLS.SPKIPins = pins
+		u, err := NewUpstream(sc, 10, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// correct pin and client cert
+	exchangeTestQuery(t, newUpstream(true, spkiPin(leaf)))
+
+	// no client cert, server should reject the handshake
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := newUpstream(false).Exchange(t.Context(), q); err == nil {
+		t.Fatal("exchange without client cert should fail")
+	}
+
+	// wrong pin
+	before := statsCounter(statsTLSPinMismatch)
+	_, err = newUpstream(true, spkiPin(clientLeaf)).Exchange(t.Context(), q)
+	if !errors.Is(err, errSPKIPinMismatch) {
+		t.Fatalf("want pin mismatch err, got %v", err)
+	}
+	if statsCounter(statsTLSPinMismatch) != before+1 {
+		t.Fatal("pin mismatch is not counted")
+	}
+}
+
+func Test_upstreamDoT_pinnedCertificateNotOwned(t *testing.T) {
+	realCert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeCert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realLeaf, err := x509.ParseCertificate(realCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeLeaf, err := x509.ParseCertificate(fakeCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serveDoT starts a DoT server that presents cert.
+	serveDoT := func(cert tls.Certificate) string {
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs := dns.Server{Net: "tcp-tls", Listener: l, TLSConfig: tlsConfig, Handler: &vServer{ip: ip("0.0.0.1")}}
+		go rs.ActivateAndServe()
+		t.Cleanup(func() { rs.Shutdown() })
+		return l.Addr().String()
+	}
+	newUpstream := func(addr string, insecure bool, root *x509.Certificate) Upstream {
+		sc := &BasicServerConfig{Addr: addr, Protocol: "dot", InsecureSkipVerify: insecure}
+		sc.DoT.ServerName = "example.com"
+		sc.TLS.SPKIPins = []string{spkiPin(realLeaf)}
+		roots := x509.NewCertPool()
+		roots.AddCert(root)
+		u, err := NewUpstream(sc, 10, roots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// the real server
+	realAddr := serveDoT(realCert)
+	exchangeTestQuery(t, newUpstream(realAddr, true, realLeaf))
+	exchangeTestQuery(t, newUpstream(realAddr, false, realLeaf))
+
+	// a server that has a trusted certificate and sends a copy of the pinned certificate.
+	fakeCert.Certificate = append(fakeCert.Certificate, realCert.Certificate[0])
+	fakeAddr := serveDoT(fakeCert)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	for _, insecure := range []bool{true, false} {
+		_, err := newUpstream(fakeAddr, insecure, fakeLeaf).Exchange(t.Context(), q)
+		if !errors.Is(err, errSPKIPinMismatch) {
+			t.Fatalf("insecure %v: want pin mismatch err, got %v", insecure, err)
+		}
+	}
+}
+
+func Test_parseSPKIPins(t *testing.T) {
+	if _, err := parseSPKIPins([]string{"YZPgTZ+woNCCCIW3LH2CxQeLzB/1m42QcCTBSdgayjs="}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSPKIPins([]string{"sha256/YZPgTZ+woNCCCIW3LH2CxQeLzB/1m42QcCTBSdgayjs="}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pin := range []string{"", "not base64", "YWJj"} {
+		if _, err := parseSPKIPins([]string{pin}); err == nil {
+			t.Fatalf("invalid pin %q should be rejected", pin)
+		}
+	}
+}
+
+// writeTestCertificate writes cert and its key to PEM files.
+func writeTestCertificate(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	dir := t.TempDir()
+	b, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func statsCounter(key string) int64 {
+	if v, ok := stats.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
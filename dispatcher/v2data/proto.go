@@ -0,0 +1,104 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package v2data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	errBrokenVarint = errors.New("broken varint")
+	errShortData    = errors.New("unexpected end of data")
+)
+
+// decodeVarint decodes a varint from b. n is 0 if b is not a valid varint.
+func decodeVarint(b []byte) (x uint64, n int) {
+	for shift := uint(0); shift < 64; shift += 7 {
+		if n >= len(b) {
+			return 0, 0
+		}
+		c := b[n]
+		n++
+		x |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return x, n
+		}
+	}
+	return 0, 0
+}
+
+// walkFields calls f for every field in the protobuf message b.
+// For varint fields, v is the raw varint. For fixed fields, v is the raw
+// little endian value. For length-delimited fields, v is the payload.
+// v shares the same underlying array with b.
+func walkFields(b []byte, f func(num int, v []byte) error) error {
+	for len(b) > 0 {
+		key, n := decodeVarint(b)
+		if n == 0 {
+			return errBrokenVarint
+		}
+		b = b[n:]
+
+		num := int(key >> 3)
+		var v []byte
+		switch wt := key & 7; wt {
+		case wireVarint:
+			_, n := decodeVarint(b)
+			if n == 0 {
+				return errBrokenVarint
+			}
+			v, b = b[:n], b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errShortData
+			}
+			v, b = b[:8], b[8:]
+		case wireBytes:
+			l, n := decodeVarint(b)
+			if n == 0 {
+				return errBrokenVarint
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return errShortData
+			}
+			v, b = b[:l], b[l:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errShortData
+			}
+			v, b = b[:4], b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wt)
+		}
+
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
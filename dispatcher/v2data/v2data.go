@@ -0,0 +1,220 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package v2data loads domain and ip lists from v2ray geosite.dat and geoip.dat files.
+package v2data
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/domainlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/iptrie"
+)
+
+// domain types in v2ray router.Domain
+const (
+	domainTypePlain  = 0
+	domainTypeRegex  = 1
+	domainTypeDomain = 2
+	domainTypeFull   = 3
+)
+
+var errTagNotFound = errors.New("tag not found")
+
+// LoadGeoSite loads the domains of the category tag from a geosite.dat file.
+// tag is case-insensitive. A tag can have an attribute filter, e.g. "google@cn",
+// in which case only domains that have the attribute "cn" are loaded.
+func LoadGeoSite(file, tag string) (*domainlist.List, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeGeoSite(b, tag)
+}
+
+// DecodeGeoSite decodes the domains of the category tag from the raw data of a geosite.dat file.
+func DecodeGeoSite(b []byte, tag string) (*domainlist.List, error) {
+	var attr string
+	if i := strings.IndexByte(tag, '@'); i != -1 {
+		tag, attr = tag[:i], tag[i+1:]
+	}
+
+	entry, err := findEntry(b, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	l := domainlist.New()
+	// message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+	err = walkFields(entry, func(num int, v []byte) error {
+		if num != 2 {
+			return nil
+		}
+		return decodeDomain(v, attr, l)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid geosite entry [%s]: %w", tag, err)
+	}
+	return l, nil
+}
+
+func decodeDomain(b []byte, attr string, l *domainlist.List) error {
+	// message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+	var t uint64
+	var value string
+	hasAttr := len(attr) == 0
+	err := walkFields(b, func(num int, v []byte) error {
+		switch num {
+		case 1:
+			x, n := decodeVarint(v)
+			if n == 0 {
+				return errBrokenVarint
+			}
+			t = x
+		case 2:
+			value = string(v)
+		case 3:
+			if !hasAttr {
+				// message Attribute { string key = 1; ... }
+				return walkFields(v, func(num int, v []byte) error {
+					if num == 1 && strings.EqualFold(string(v), attr) {
+						hasAttr = true
+					}
+					return nil
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !hasAttr {
+		return nil
+	}
+
+	switch t {
+	case domainTypePlain:
+		l.AddKeyword(value)
+	case domainTypeRegex:
+		if err := l.AddRegexp(value); err != nil {
+			return fmt.Errorf("invalid regexp [%s]: %w", value, err)
+		}
+	case domainTypeDomain:
+		l.Add(domainToFqdn(value))
+	case domainTypeFull:
+		l.AddFull(domainToFqdn(value))
+	default:
+		return fmt.Errorf("unknown domain type %d", t)
+	}
+	return nil
+}
+
+func domainToFqdn(s string) string {
+	if strings.HasSuffix(s, ".") {
+		return s
+	}
+	return s + "."
+}
+
+// LoadGeoIP loads the cidrs of the category tag from a geoip.dat file.
+// tag is case-insensitive.
+func LoadGeoIP(file, tag string) (*iptrie.Trie, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeGeoIP(b, tag)
+}
+
+// DecodeGeoIP decodes the cidrs of the category tag from the raw data of a geoip.dat file.
+func DecodeGeoIP(b []byte, tag string) (*iptrie.Trie, error) {
+	entry, err := findEntry(b, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	l := iptrie.New()
+	// message GeoIP { string country_code = 1; repeated CIDR cidr = 2; }
+	err = walkFields(entry, func(num int, v []byte) error {
+		if num != 2 {
+			return nil
+		}
+
+		// message CIDR { bytes ip = 1; uint32 prefix = 2; }
+		var ip net.IP
+		var prefix uint64
+		err := walkFields(v, func(num int, v []byte) error {
+			switch num {
+			case 1:
+				ip = net.IP(v)
+			case 2:
+				x, n := decodeVarint(v)
+				if n == 0 {
+					return errBrokenVarint
+				}
+				prefix = x
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			return fmt.Errorf("invalid ip length %d", len(ip))
+		}
+		if _, err := l.InsertPrefix(ip, int(prefix)); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid geoip entry [%s]: %w", tag, err)
+	}
+	return l, nil
+}
+
+// findEntry finds the entry that has the country_code tag in
+// a GeoSiteList or GeoIPList. Both lists have the same layout:
+// message List { repeated Entry entry = 1; }
+// message Entry { string country_code = 1; ... }
+func findEntry(b []byte, tag string) ([]byte, error) {
+	var entry []byte
+	err := walkFields(b, func(num int, v []byte) error {
+		if num != 1 || entry != nil {
+			return nil
+		}
+		return walkFields(v, func(num int, code []byte) error {
+			if num == 1 && strings.EqualFold(string(code), tag) {
+				entry = v
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %s", errTagNotFound, tag)
+	}
+	return entry, nil
+}
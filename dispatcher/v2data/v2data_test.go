@@ -0,0 +1,139 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package v2data
+
+import (
+	"net"
+	"testing"
+)
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func appendBytesField(b []byte, num int, v []byte) []byte {
+	b = appendVarint(b, uint64(num<<3|wireBytes))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarintField(b []byte, num int, x uint64) []byte {
+	b = appendVarint(b, uint64(num<<3|wireVarint))
+	return appendVarint(b, x)
+}
+
+func testDomain(t uint64, v string, attrs ...string) []byte {
+	b := appendVarintField(nil, 1, t)
+	b = appendBytesField(b, 2, []byte(v))
+	for _, a := range attrs {
+		attr := appendBytesField(nil, 1, []byte(a))
+		attr = appendVarintField(attr, 2, 1) // bool_value
+		b = appendBytesField(b, 3, attr)
+	}
+	return b
+}
+
+func Test_DecodeGeoSite(t *testing.T) {
+	cn := appendBytesField(nil, 1, []byte("CN"))
+	cn = appendBytesField(cn, 2, testDomain(domainTypeDomain, "cn"))
+	cn = appendBytesField(cn, 2, testDomain(domainTypeFull, "a.com", "ads"))
+	cn = appendBytesField(cn, 2, testDomain(domainTypePlain, "baidu"))
+	cn = appendBytesField(cn, 2, testDomain(domainTypeRegex, `^b\.[a-z]+$`))
+	other := appendBytesField(nil, 1, []byte("GOOGLE"))
+	other = appendBytesField(other, 2, testDomain(domainTypeDomain, "google.com"))
+
+	var dat []byte
+	dat = appendBytesField(dat, 1, other)
+	dat = appendBytesField(dat, 1, cn)
+
+	l, err := DecodeGeoSite(dat, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 4 {
+		t.Fatalf("want 4 domains, got %d", l.Len())
+	}
+	for _, s := range []string{"x.cn.", "a.com.", "www.baidu.com.", "b.net."} {
+		if !l.Has(s) {
+			t.Fatalf("%s should be in the list", s)
+		}
+	}
+	for _, s := range []string{"x.a.com.", "google.com.", "a.b.net."} {
+		if l.Has(s) {
+			t.Fatalf("%s should not be in the list", s)
+		}
+	}
+
+	l, err = DecodeGeoSite(dat, "cn@ads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 1 || !l.Has("a.com.") {
+		t.Fatal("attribute filter failed")
+	}
+
+	if _, err := DecodeGeoSite(dat, "us"); err == nil {
+		t.Fatal("missing tag should be an error")
+	}
+	if _, err := DecodeGeoSite(dat[:len(dat)-1], "cn"); err == nil {
+		t.Fatal("broken data should be an error")
+	}
+}
+
+func Test_DecodeGeoIP(t *testing.T) {
+	cidr := func(ip string, prefix uint64) []byte {
+		b := net.ParseIP(ip)
+		if b4 := b.To4(); b4 != nil {
+			b = b4
+		}
+		c := appendBytesField(nil, 1, b)
+		return appendVarintField(c, 2, prefix)
+	}
+
+	cn := appendBytesField(nil, 1, []byte("CN"))
+	cn = appendBytesField(cn, 2, cidr("1.0.1.0", 24))
+	cn = appendBytesField(cn, 2, cidr("2001:250::", 35))
+	var dat []byte
+	dat = appendBytesField(dat, 1, cn)
+
+	l, err := DecodeGeoIP(dat, "CN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 2 {
+		t.Fatalf("want 2 cidrs, got %d", l.Len())
+	}
+
+	contains := func(s string) bool {
+		return l.Contains(net.ParseIP(s))
+	}
+	for _, s := range []string{"1.0.1.1", "2001:250::1"} {
+		if !contains(s) {
+			t.Fatalf("%s should be in the list", s)
+		}
+	}
+	for _, s := range []string{"1.0.2.1", "2001:250:2000::1"} {
+		if contains(s) {
+			t.Fatalf("%s should not be in the list", s)
+		}
+	}
+}
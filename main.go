@@ -44,6 +44,10 @@ var (
 	configPath  = flag.String("c", "config.yaml", "[path] load config from file")
 	genConfigTo = flag.String("gen", "", "[path] generate a config template here")
 
+	compileDomainList = flag.String("compile-domain", "", "[path] compile a text domain list to binary format")
+	compileIPList     = flag.String("compile-ip", "", "[path] compile a text ip list to binary format")
+	compileTo         = flag.String("compile-to", "", "[path] save the compiled list here, default is the source path with a .bin suffix")
+
 	dir                 = flag.String("dir", "", "[path] change working directory to here")
 	dirFollowExecutable = flag.Bool("dir2exe", false, "change working directory to the executable that started the current process")
 
@@ -81,7 +85,7 @@ func main() {
 		entry.Infof("pprof is listening at %s", *pprofAddr)
 		go func() {
 			if err := http.ListenAndServe(*pprofAddr, nil); err != nil {
-				entry.Fatal("pprof backend is exited: %v", err)
+				entry.Fatalf("pprof backend is exited: %v", err)
 			}
 		}()
 	}
@@ -117,6 +121,24 @@ func main() {
 		return
 	}
 
+	// compile list
+	if len(*compileDomainList) != 0 || len(*compileIPList) != 0 {
+		src, isIPList := *compileDomainList, false
+		if len(*compileIPList) != 0 {
+			src, isIPList = *compileIPList, true
+		}
+		dst := *compileTo
+		if len(dst) == 0 {
+			dst = src + ".bin"
+		}
+		start := time.Now()
+		if err := dispatcher.CompileList(src, dst, isIPList); err != nil {
+			entry.Fatalf("main: can not compile list %s: %v", src, err)
+		}
+		entry.Infof("main: list %s compiled to %s in %s", src, dst, time.Since(start))
+		return
+	}
+
 	// try to change working dir to os.Executable() or *dir
 	var wd string
 	if *dirFollowExecutable {
@@ -153,9 +175,14 @@ func main() {
 		entry.Fatalf("main: init dispatcher: %v", err)
 	}
 
+	maxUDPSize := dispatcher.MaxUDPSize
+	if c.Bind.MaxUDPSize > 0 {
+		maxUDPSize = c.Bind.MaxUDPSize
+	}
+
 	startServerExitWhenFailed := func(network string) {
 		entry.Infof("main: %s server started", network)
-		if err := d.ListenAndServe(network, c.Bind.Addr, dispatcher.MaxUDPSize); err != nil {
+		if err := d.ListenAndServe(network, c.Bind.Addr, maxUDPSize); err != nil {
 			entry.Fatalf("main: %s server exited with err: %v", network, err)
 		} else {
 			entry.Infof("main: %s server exited", network)
@@ -189,6 +216,7 @@ func printStatus(entry *logrus.Entry, d time.Duration) {
 		time.Sleep(d)
 		runtime.ReadMemStats(m)
 		entry.Infof("printStatus: HeapObjects: %d NumGC: %d PauseTotalNs: %d, NumGoroutine: %d", m.HeapObjects, m.NumGC, m.PauseTotalNs, runtime.NumGoroutine())
+		entry.Infof("printStatus: stats: %s", dispatcher.StatsString())
 	}
 }
 